@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// maxInject is the largest payload accepted by the admin endpoint
+const maxInject = 1 << 20
+
+// adminServer lists the active connections, with their stats, and injects
+// frames into them
+//
+//	GET  /conns                            lists the connections
+//	GET  /conns/ID                         shows a connection
+//	POST /conns/ID?to=server&type=text     sends the body to the server
+//	POST /conns/ID?to=client&type=binary   sends the body to the client
+//	GET  /healthz                          answers while the process serves
+//	GET  /readyz                           answers once upstreams are usable
+type adminServer struct {
+	// ready, if set, is called by /readyz to tell whether the upstreams can
+	// be reached
+	ready func(ctx context.Context) error
+	// readonly refuses to inject frames, on -readonly
+	readonly bool
+
+	lock sync.Mutex
+	// conns are keyed by their sniffer.ConnID, so the ids match the logs
+	conns map[uint64]*adminConn
+}
+
+type adminConn struct {
+	id       uint64
+	upstream string
+	s        *session
+}
+
+// adminConnView is how a connection is shown
+type adminConnView struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	URL        string    `json:"url"`
+	Upstream   string    `json:"upstream"`
+	Opened     time.Time `json:"opened"`
+	// LastActivity is when the last byte was seen in either direction
+	LastActivity time.Time `json:"last_activity"`
+	Client       dirStats  `json:"client"`
+	Server       dirStats  `json:"server"`
+}
+
+func (c *adminConn) view() adminConnView {
+	stats := c.s.snapshot()
+	v := adminConnView{
+		ID:           c.id,
+		RemoteAddr:   c.s.req.RemoteAddr,
+		URL:          c.s.req.URL.String(),
+		Upstream:     c.upstream,
+		Opened:       c.s.opened,
+		LastActivity: c.s.opened,
+		Client:       stats[sniffer.ClientToServer],
+		Server:       stats[sniffer.ServerToClient],
+	}
+	for _, st := range stats {
+		if st.Last.After(v.LastActivity) {
+			v.LastActivity = st.Last
+		}
+	}
+	return v
+}
+
+func newAdminServer() *adminServer {
+	return &adminServer{conns: make(map[uint64]*adminConn)}
+}
+
+// add registers the connection of a session, the returned function must be
+// called once it is done
+func (a *adminServer) add(s *session, upstream string) func() {
+	id, _ := strconv.ParseUint(sniffer.ConnID(s.req), 10, 64)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := &adminConn{id: id, upstream: upstream, s: s}
+	a.conns[c.id] = c
+	return func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		delete(a.conns, c.id)
+	}
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		io.WriteString(w, "ok\n")
+		return
+	case "/readyz":
+		if a.ready != nil {
+			if err := a.ready(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		io.WriteString(w, "ok\n")
+		return
+	}
+	if r.URL.Path == "/conns" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.list(w)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/conns/"), 10, 64)
+	if err != nil || !strings.HasPrefix(r.URL.Path, "/conns/") {
+		http.NotFound(w, r)
+		return
+	}
+	a.lock.Lock()
+	c := a.conns[id]
+	a.lock.Unlock()
+	if c == nil {
+		http.Error(w, "unknown connection", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, c.view())
+	case http.MethodPost:
+		a.inject(w, r, c)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminServer) list(w http.ResponseWriter) {
+	a.lock.Lock()
+	conns := make([]adminConnView, 0, len(a.conns))
+	for _, c := range a.conns {
+		conns = append(conns, c.view())
+	}
+	a.lock.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	writeJSON(w, conns)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *adminServer) inject(w http.ResponseWriter, r *http.Request, c *adminConn) {
+	if a.readonly {
+		http.Error(w, "frames can't be injected on -readonly", http.StatusForbidden)
+		return
+	}
+	var dir sniffer.Direction
+	switch r.URL.Query().Get("to") {
+	case "server":
+		dir = sniffer.ClientToServer
+	case "client":
+		dir = sniffer.ServerToClient
+	default:
+		http.Error(w, "to must be server or client", http.StatusBadRequest)
+		return
+	}
+	f := &sniffer.Frame{Fin: true}
+	switch r.URL.Query().Get("type") {
+	case "", "text":
+		f.Opcode = sniffer.OpText
+	case "binary":
+		f.Opcode = sniffer.OpBinary
+	default:
+		http.Error(w, "type must be text or binary", http.StatusBadRequest)
+		return
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInject))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	f.Payload = payload
+	if err := sniffer.Inject(c.s.req, dir, f); err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, sniffer.ErrNotInjectable) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Printf("%s %s injected %s %d bytes\n", dir, connName(c.s.req), f.Opcode,
+		len(payload))
+	w.WriteHeader(http.StatusNoContent)
+}
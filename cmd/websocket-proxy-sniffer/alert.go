@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// alertBuckets is the number of slots the -alert-window is split into, it
+// bounds the memory of each detector
+const alertBuckets = 10
+
+// rateAlert detects bursts of frames on -alert-fps. Frames are counted in
+// buckets that slide along with time, so the rate covers the last window.
+// Each read loop owns its own, it isn't safe for concurrent use
+type rateAlert struct {
+	threshold float64
+	window    time.Duration
+	buckets   [alertBuckets]uint64
+	cur       int
+	// start is when the current bucket began
+	start time.Time
+	// alerting is set while the rate is above the threshold, so a burst is
+	// reported once
+	alerting bool
+}
+
+// newRateAlert returns a detector for rates above fps frames per second, or
+// nil if fps isn't positive
+func newRateAlert(fps float64, window time.Duration) *rateAlert {
+	if fps <= 0 {
+		return nil
+	}
+	return &rateAlert{threshold: fps, window: window}
+}
+
+// add counts a frame seen at now and returns the rate over the window when it
+// goes above the threshold, a nil detector never does
+func (a *rateAlert) add(now time.Time) (float64, bool) {
+	if a == nil {
+		return 0, false
+	}
+	step := a.window / alertBuckets
+	if a.start.IsZero() {
+		a.start = now
+	}
+	if n := int64(now.Sub(a.start) / step); n > 0 {
+		for i := int64(0); i < n && i < alertBuckets; i++ {
+			a.cur = (a.cur + 1) % alertBuckets
+			a.buckets[a.cur] = 0
+		}
+		a.start = a.start.Add(time.Duration(n) * step)
+	}
+	a.buckets[a.cur]++
+
+	var total uint64
+	for _, b := range a.buckets {
+		total += b
+	}
+	rate := float64(total) / a.window.Seconds()
+	if rate <= a.threshold {
+		a.alerting = false
+		return rate, false
+	}
+	if a.alerting {
+		return rate, false
+	}
+	a.alerting = true
+	return rate, true
+}
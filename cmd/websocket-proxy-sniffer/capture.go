@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// capture saves the raw traffic of a connection, client to server bytes go to
+// the .in file and server to client bytes go to the .out file. Redacted
+// captures have neither, only the .ndjson file
+type capture struct {
+	in  *sniffer.FlushWriter
+	out *sniffer.FlushWriter
+	// ndjson, if set, records the frames of both directions with their
+	// time to the .ndjson file
+	ndjson     *sniffer.CaptureWriter
+	ndjsonFile *sniffer.FlushWriter
+	// base is the path of the files without extension
+	base string
+}
+
+// newCapture creates the capture files of r in dir, writes are buffered and
+// flushed every flushInterval and on Close. With raw the .in and .out files
+// are created, with ndjson the .ndjson file. With compress the files are
+// gzipped and their names end in .gz
+func newCapture(dir string, r *http.Request, flushInterval time.Duration,
+	compress, raw, ndjson bool) (*capture, error) {
+	// the connection id keeps names unique even when the same remote address
+	// connects twice within the same second
+	name := fmt.Sprintf("%s_%s_%s", addrFileName(r.RemoteAddr),
+		time.Now().Format("20060102T150405"), sniffer.ConnID(r))
+	base := filepath.Join(dir, name)
+
+	c := &capture{base: base}
+	if raw {
+		in, err := createCaptureFile(base+".in", compress)
+		if err != nil {
+			return nil, err
+		}
+		out, err := createCaptureFile(base+".out", compress)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		c.in = sniffer.NewFlushWriter(in, flushInterval)
+		c.out = sniffer.NewFlushWriter(out, flushInterval)
+	}
+	if ndjson {
+		f, err := createCaptureFile(base+".ndjson", compress)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.ndjsonFile = sniffer.NewFlushWriter(f, flushInterval)
+		c.ndjson = sniffer.NewCaptureWriter(c.ndjsonFile)
+	}
+	return c, nil
+}
+
+func createCaptureFile(name string, compress bool) (io.WriteCloser, error) {
+	if !compress {
+		return os.Create(name)
+	}
+	f, err := os.Create(name + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+}
+
+// gzipFile compresses the writes to a file, closing it ends the gzip stream
+// before closing the file so it can be read back
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeHandshake saves the handshake dump of the connection to the
+// .handshake file, redacted by redact if it is set
+func (c *capture) writeHandshake(r *http.Request, hs *sniffer.Handshake,
+	redact *redactor) error {
+	f, err := os.Create(c.base + ".handshake")
+	if err != nil {
+		return err
+	}
+	if err := dumpHandshake(f, r, hs, redact); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// targetDir returns the directory under dir for the captures of the upstream
+// host, creating it if needed
+func targetDir(dir, host string) (string, error) {
+	dir = filepath.Join(dir, addrFileName(host))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// addrFileName turns a host:port address into something usable in a file
+// name, IPv6 hosts lose their brackets and have their colons and zone
+// replaced, so [fe80::1%eth0]:443 becomes fe80__1_eth0_443
+func addrFileName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return sanitizeFileName(addr)
+	}
+	return sanitizeFileName(host) + "_" + sanitizeFileName(port)
+}
+
+// sanitizeFileName replaces anything but letters, digits, dots and dashes
+// with an underscore
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (c *capture) Close() error {
+	var err error
+	for _, w := range []*sniffer.FlushWriter{c.in, c.out, c.ndjsonFile} {
+		if w == nil {
+			continue
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// checkTimeout bounds the handshake with each upstream on -check
+const checkTimeout = 10 * time.Second
+
+// check performs a websocket handshake with every upstream through rt, the
+// transport of the proxy, and logs what was negotiated. It returns the
+// first error but tries all of them
+func check(ctx context.Context, rt http.RoundTripper, targets []*url.URL) error {
+	var first error
+	for _, u := range targets {
+		if err := checkTarget(ctx, rt, u); err != nil {
+			log.Printf("check %s: %v\n", u, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func checkTarget(ctx context.Context, rt http.RoundTripper, u *url.URL) error {
+	hs, err := probe(ctx, rt, u)
+	if err != nil {
+		return err
+	}
+	log.Printf("check %s ok, protocol %q extensions %q\n", u, hs.Protocol(),
+		strings.Join(hs.Extensions(), ", "))
+	return nil
+}
+
+// probe performs a websocket handshake with u and closes the connection
+func probe(ctx context.Context, rt http.RoundTripper, u *url.URL) (*sniffer.Handshake, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	// offer compression to see whether the upstream supports it
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	conn, resp, err := dialWebSocket(ctx, rt, u, header)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	hs := &sniffer.Handshake{Upstream: u, Header: resp.Header}
+
+	// say goodbye properly, the upstream doesn't need to answer
+	f := &sniffer.Frame{Fin: true, Opcode: sniffer.OpClose, Payload: []byte{0x03, 0xe8}}
+	if err := f.Mask(); err != nil {
+		return nil, err
+	}
+	return hs, sniffer.WriteFrame(conn, f)
+}
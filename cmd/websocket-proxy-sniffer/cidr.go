@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientFilter sniffs the clients allowed by their IP. Denied clients are
+// proxied without being sniffed, so nothing of them is logged or captured,
+// or get a 403 with reject
+type clientFilter struct {
+	sniffed http.Handler
+	// bypass proxies the denied clients
+	bypass http.Handler
+	// allow, if not empty, are the only networks sniffed, deny wins over it
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	reject bool
+}
+
+// newClientFilter returns a clientFilter for the -allow-cidr and -deny-cidr
+// networks
+func newClientFilter(sniffed, bypass http.Handler, allow, deny []string,
+	reject bool) (*clientFilter, error) {
+	c := &clientFilter{sniffed: sniffed, bypass: bypass, reject: reject}
+	var err error
+	if c.allow, err = parseCIDRs("allow-cidr", allow); err != nil {
+		return nil, err
+	}
+	if c.deny, err = parseCIDRs("deny-cidr", deny); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseCIDRs parses the values of the flag named name, each can be a comma
+// separated list
+func parseCIDRs(name string, values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -%s %q: %w", name, s, err)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// allowed reports whether the client of RemoteAddr addr is sniffed. Clients
+// without an IP, like those of unix sockets, are only sniffed when there is
+// no allow list
+func (c *clientFilter) allowed(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	// the zone of link local addresses isn't part of the network
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(c.allow) == 0
+	}
+	for _, n := range c.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, n := range c.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *clientFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case c.allowed(r.RemoteAddr):
+		c.sniffed.ServeHTTP(w, r)
+	case c.reject:
+		http.Error(w, "client not allowed", http.StatusForbidden)
+	default:
+		c.bypass.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// dialWebSocket performs a client handshake with the target using rt, which
+// should be the same transport used by the proxy, and returns the upgraded
+// connection
+func dialWebSocket(ctx context.Context, rt http.RoundTripper, u *url.URL,
+	header http.Header) (io.ReadWriteCloser, *http.Response, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("websocket handshake with %s: %s", u, resp.Status)
+	}
+	if !sniffer.ValidAccept(key, resp.Header.Get("Sec-WebSocket-Accept")) {
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("websocket handshake with %s: "+
+			"Sec-WebSocket-Accept doesn't match the key", u)
+	}
+	// the transport returns the upgraded connection as the body
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("websocket handshake with %s: body isn't writable", u)
+	}
+	return conn, resp, nil
+}
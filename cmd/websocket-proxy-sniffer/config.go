@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config holds all the settings of the sniffer, each field is set by the flag
+// of the same name. Target, Listen and Format can also be set from the
+// environment, which is handy in containers. Flags take precedence over the
+// environment, which takes precedence over the defaults
+type Config struct {
+	Target string
+	Mode   string
+	Routes []string
+	// Listens are the addresses to listen on, Listen is used if it is empty
+	Listens     []string
+	Listen      string
+	CORSOrigin  string
+	CORSHeaders string
+	Insecure    bool
+	Cert        string
+	Key         string
+	HTTP2       bool
+
+	Format        string
+	UTC           bool
+	Pretty        bool
+	Binary        string
+	Color         string
+	MaxLogBytes   int
+	Outdir        string
+	Compress      bool
+	NDJSON        bool
+	Pcap          string
+	FlushInterval time.Duration
+	Publish       string
+	MetricsListen string
+	AdminListen   string
+
+	PingWindow  time.Duration
+	BufSize     int
+	MaxFrame    uint64
+	MaxMessage  uint64
+	Filter      string
+	HeadersOnly bool
+	Opcode      string
+	Sample      float64
+	SampleSeed  int64
+	TrustXFF    bool
+	AllowCIDR   []string
+	DenyCIDR    []string
+	// DenyAction is proxy or reject
+	DenyAction  string
+	Direction   string
+	Exec        string
+	ExecMax     int
+	AlertFPS    float64
+	AlertWindow time.Duration
+
+	Replay   string
+	Realtime bool
+	Connect  string
+	Send     string
+	Decode   string
+	Masked   bool
+
+	MaxConns   int
+	RateIn     int
+	RateOut    int
+	RateGlobal bool
+	History    int
+	Har        string
+
+	UpstreamRetries int
+	UpstreamBackoff time.Duration
+	DialTimeout     time.Duration
+	KeepAlive       time.Duration
+
+	Verbosity  int
+	Mirror     string
+	SetHeaders []string
+	// Origin, if not nil, replaces the Origin of the handshake sent upstream,
+	// an empty one removes it
+	Origin     *string
+	Redact     []string
+	Echo       bool
+	ReadyProbe bool
+	Readonly   bool
+	Check      bool
+
+	IdleTimeout     time.Duration
+	HeaderTimeout   time.Duration
+	Strict          bool
+	Handshake       bool
+	CountOnly       bool
+	StatsInterval   time.Duration
+	Summary         bool
+	ShutdownTimeout time.Duration
+	Log             string
+	Syslog          bool
+}
+
+// defaultConfig returns the settings used when neither flags nor environment
+// variables are set
+func defaultConfig() Config {
+	return Config{
+		Target:          "ws://echo.websocket.org",
+		Mode:            "reverse",
+		Listen:          "localhost:8080",
+		Format:          "text",
+		Binary:          "hex",
+		Color:           "auto",
+		FlushInterval:   time.Second,
+		PingWindow:      30 * time.Second,
+		BufSize:         4096,
+		MaxFrame:        64 << 20,
+		MaxMessage:      256 << 20,
+		Sample:          1,
+		Direction:       "both",
+		DenyAction:      "proxy",
+		ExecMax:         16,
+		AlertWindow:     10 * time.Second,
+		UpstreamBackoff: 500 * time.Millisecond,
+		DialTimeout:     10 * time.Second,
+		KeepAlive:       30 * time.Second,
+		Verbosity:       verbosityPayload,
+		StatsInterval:   10 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// applyEnv overrides the settings with the non empty SNIFFER_* variables
+// returned by getenv, usually os.Getenv
+func (c *Config) applyEnv(getenv func(string) string) {
+	for name, v := range map[string]*string{
+		"SNIFFER_TARGET": &c.Target,
+		"SNIFFER_LISTEN": &c.Listen,
+		"SNIFFER_FORMAT": &c.Format,
+	} {
+		if s := getenv(name); s != "" {
+			*v = s
+		}
+	}
+}
+
+// validate checks the settings make sense together, the values that need
+// parsing are checked when they are used
+func (c *Config) validate() error {
+	if c.Mode != "reverse" && c.Mode != "transparent" {
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("both -cert and -key are required to serve tls")
+	}
+	if c.HTTP2 {
+		specs, err := c.listenSpecs()
+		if err != nil {
+			return err
+		}
+		anyTLS := false
+		for _, l := range specs {
+			anyTLS = anyTLS || l.cert != ""
+		}
+		if !anyTLS {
+			return errors.New("-http2 requires -cert and -key or a tls -listen")
+		}
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return errors.New("-sample must be between 0 and 1")
+	}
+	if c.Readonly {
+		if err := conflicts("readonly", []flagUse{
+			{"exec", c.Exec != ""},
+			{"header-timeout", c.HeaderTimeout > 0},
+			{"set-header", len(c.SetHeaders) > 0},
+			{"origin", c.Origin != nil},
+		}); err != nil {
+			return err
+		}
+	}
+	if c.CountOnly {
+		if err := conflicts("count-only", []flagUse{
+			{"outdir", c.Outdir != ""},
+			{"pcap", c.Pcap != ""},
+			{"har", c.Har != ""},
+			{"exec", c.Exec != ""},
+			{"mirror", c.Mirror != ""},
+			{"admin-listen", c.AdminListen != ""},
+			{"summary", c.Summary},
+			{"handshake", c.Handshake},
+			{"filter", c.Filter != ""},
+			{"opcode", c.Opcode != ""},
+			{"sample", c.Sample != 1},
+			{"redact", len(c.Redact) > 0},
+			{"header-timeout", c.HeaderTimeout > 0},
+			{"direction", c.Direction != "both"},
+			{"publish", c.Publish != ""},
+			{"history", c.History != 0},
+		}); err != nil {
+			return err
+		}
+		if c.StatsInterval <= 0 {
+			return errors.New("-stats-interval must be positive")
+		}
+	}
+	if c.HeadersOnly {
+		if err := conflicts("headers-only", []flagUse{
+			{"filter", c.Filter != ""},
+			{"opcode", c.Opcode != ""},
+			{"sample", c.Sample != 1},
+			{"pretty", c.Pretty},
+			{"binary", c.Binary != "hex"},
+			{"max-log-bytes", c.MaxLogBytes != 0},
+		}); err != nil {
+			return err
+		}
+	}
+	if c.History < 0 || c.History > historyMax {
+		return fmt.Errorf("-history must be between 0 and %d", historyMax)
+	}
+	if c.Compress && c.Outdir == "" {
+		return errors.New("-compress needs -outdir")
+	}
+	if c.NDJSON && c.Outdir == "" {
+		return errors.New("-ndjson needs -outdir")
+	}
+	if c.CORSHeaders != "" && c.CORSOrigin == "" {
+		return errors.New("-cors-headers needs -cors-origin")
+	}
+	if c.ReadyProbe && c.AdminListen == "" {
+		return errors.New("-ready-probe needs -admin-listen")
+	}
+	if c.Exec != "" && c.ExecMax < 1 {
+		return errors.New("-exec-max must be at least 1")
+	}
+	if c.AlertFPS > 0 && c.AlertWindow < alertBuckets*time.Millisecond {
+		return fmt.Errorf("-alert-window must be at least %s", alertBuckets*time.Millisecond)
+	}
+	// raw captures store the traffic as it is on the wire, where payloads
+	// can be masked, compressed or split across frames
+	if len(c.Redact) > 0 && c.Pcap != "" {
+		return errors.New("-redact can't be used with -pcap, pcap files hold " +
+			"the raw bytes on the wire, which can't be redacted")
+	}
+	if len(c.Redact) > 0 && c.Outdir != "" && !c.NDJSON {
+		return errors.New("-redact needs -ndjson to save to -outdir, the raw " +
+			".in and .out files hold the bytes on the wire, which can't be redacted")
+	}
+	if c.DenyAction != "proxy" && c.DenyAction != "reject" {
+		return fmt.Errorf("unknown -deny-action %q", c.DenyAction)
+	}
+	if c.DenyAction == "reject" && len(c.AllowCIDR) == 0 && len(c.DenyCIDR) == 0 {
+		return errors.New("-deny-action needs -allow-cidr or -deny-cidr")
+	}
+	// raw captures don't record when each frame was sent
+	if c.Realtime && !isNDJSON(c.Replay) {
+		return errors.New("-realtime needs a .ndjson -replay capture")
+	}
+	if c.Send != "" && c.Connect == "" {
+		return errors.New("-send needs -connect")
+	}
+	return nil
+}
+
+// flagUse tells whether a flag is set
+type flagUse struct {
+	name string
+	set  bool
+}
+
+// conflicts returns an error for the first of uses that is set, as they
+// can't be used with the flag named with
+func conflicts(with string, uses []flagUse) error {
+	for _, u := range uses {
+		if u.set {
+			return fmt.Errorf("-%s can't be used with -%s", u.name, with)
+		}
+	}
+	return nil
+}
+
+// listenSpecs returns the listeners to serve, -cert and -key apply to the
+// ones without their own
+func (c *Config) listenSpecs() ([]listenSpec, error) {
+	listens := c.Listens
+	if len(listens) == 0 {
+		listens = []string{c.Listen}
+	}
+	var specs []listenSpec
+	for _, v := range listens {
+		l, err := parseListen(v)
+		if err != nil {
+			return nil, err
+		}
+		if l.cert == "" {
+			l.cert, l.key = c.Cert, c.Key
+		}
+		specs = append(specs, l)
+	}
+	return specs, nil
+}
+
+// routes returns the -route rules, or one sending everything to -target
+func (c *Config) routes() ([]route, error) {
+	var rts []route
+	for _, s := range c.Routes {
+		rt, err := parseRoute(s)
+		if err != nil {
+			return nil, err
+		}
+		rts = append(rts, rt)
+	}
+	if len(rts) == 0 {
+		u, err := parseTarget(c.Target)
+		if err != nil {
+			return nil, err
+		}
+		rts = append(rts, route{target: u})
+	}
+	return rts, nil
+}
+
+func (c *Config) dialOptions() dialOptions {
+	return dialOptions{
+		insecure:  c.Insecure,
+		retries:   c.UpstreamRetries,
+		backoff:   c.UpstreamBackoff,
+		timeout:   c.DialTimeout,
+		keepAlive: c.KeepAlive,
+	}
+}
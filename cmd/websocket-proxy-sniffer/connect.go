@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// connectCloseWait is how long -connect waits for the server to answer its
+// close frame once the context is done
+const connectCloseWait = 5 * time.Second
+
+// connect connects to u as a websocket client, sends send as a text message
+// if it isn't empty and logs the frames of the server until it closes the
+// connection or the context is done. Server frames go through the same read
+// loop as proxied connections, the client side answers pings and closes so
+// the connection stays healthy
+func connect(ctx context.Context, rt http.RoundTripper, u *url.URL, send string,
+	s *session, frames *frameLog) error {
+	// no extensions are offered, the messages sent aren't compressed
+	conn, resp, err := dialWebSocket(context.Background(), rt, u, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the logger expects a request, use the target as the remote address
+	req := resp.Request
+	req.RemoteAddr = u.Host
+	s.req, s.opened = req, time.Now()
+	// log the url as given, the transport needs http schemes
+	wsURL := *u
+	wsURL.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	frames.logConn(sniffer.ConnEvent{
+		Event:          sniffer.ConnOpen,
+		RemoteAddr:     req.RemoteAddr,
+		URL:            wsURL.String(),
+		Upstream:       u.Host,
+		RequestHeader:  s.redact.headers(req.Header),
+		ResponseHeader: s.redact.headers(resp.Header),
+	})
+
+	var lock sync.Mutex
+	write := func(f *sniffer.Frame) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := f.Mask(); err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		sniffer.WriteFrame(&b, f)
+		n, err := conn.Write(b.Bytes())
+		s.lock.Lock()
+		s.stats[sniffer.ClientToServer].Bytes += uint64(n)
+		s.stats[sniffer.ClientToServer].Frames++
+		s.stats[sniffer.ClientToServer].Last = time.Now()
+		s.lock.Unlock()
+		return err
+	}
+	// only one close frame may be sent, whoever starts the closing handshake
+	var closeOnce sync.Once
+	sendClose := func(status []byte) error {
+		var err error
+		closeOnce.Do(func() {
+			err = write(&sniffer.Frame{Fin: true, Opcode: sniffer.OpClose, Payload: status})
+		})
+		return err
+	}
+	if send != "" {
+		f := &sniffer.Frame{Fin: true, Opcode: sniffer.OpText, Payload: []byte(send)}
+		if err := write(f); err != nil {
+			return err
+		}
+		s.logFrame(req, sniffer.ClientToServer, s.redact.frame(f))
+	}
+
+	// the read loop gets the server frames through a pipe, after they have
+	// been answered
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.readLoop(context.Background(), pr, sniffer.ServerToClient)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		sendClose([]byte{sniffer.CloseNormal >> 8, sniffer.CloseNormal & 0xff})
+		select {
+		case <-done:
+		case <-time.After(connectCloseWait):
+			conn.Close()
+		}
+	}()
+
+	fr := sniffer.NewFrameReaderSize(conn, false, s.bufSize)
+	fr.MaxSize = s.maxFrame
+	rerr := io.EOF
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			rerr = err
+			break
+		}
+		switch f.Opcode {
+		case sniffer.OpPing:
+			err = write(&sniffer.Frame{Fin: true, Opcode: sniffer.OpPong,
+				Payload: append([]byte(nil), f.Payload...)})
+		case sniffer.OpClose:
+			// echo the status, the server closes the connection then
+			var status []byte
+			if len(f.Payload) >= 2 {
+				status = append(status, f.Payload[:2]...)
+			}
+			err = sendClose(status)
+		}
+		if werr := sniffer.WriteFrame(pw, f); werr != nil || err != nil || f.Opcode == sniffer.OpClose {
+			break
+		}
+	}
+	// the read loop reports rerr as proxied connections do
+	pw.CloseWithError(rerr)
+	err = <-errc
+	frames.logConn(s.closeEvent(err))
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type connContextKey struct{}
+
+type slotContextKey struct{}
+
+// connTracker keeps track of the hijacked connections, which http.Server
+// forgets about, so they can be drained and closed on shutdown. It can also
+// limit how many are served at the same time
+type connTracker struct {
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+	// slots is nil when there is no limit
+	slots chan struct{}
+}
+
+// newConnTracker returns a tracker that serves up to max concurrent
+// connections, zero means no limit
+func newConnTracker(max int) *connTracker {
+	t := &connTracker{conns: make(map[net.Conn]struct{})}
+	if max > 0 {
+		t.slots = make(chan struct{}, max)
+	}
+	return t
+}
+
+// slot is taken by a request and released when the request is done or, if it
+// was hijacked, when the connection is done
+type slot struct {
+	t        *connTracker
+	once     sync.Once
+	hijacked bool
+}
+
+func (s *slot) release() {
+	s.once.Do(func() { <-s.t.slots })
+}
+
+// Limit rejects requests with a 503 when the maximum number of connections
+// is being served
+func (t *connTracker) Limit(next http.Handler) http.Handler {
+	if t.slots == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case t.slots <- struct{}{}:
+		default:
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		s := &slot{t: t}
+		ctx := context.WithValue(r.Context(), slotContextKey{}, s)
+		next.ServeHTTP(w, r.WithContext(ctx))
+		// hijacked requests are marked synchronously from the handler
+		if !s.hijacked {
+			s.release()
+		}
+	})
+}
+
+// ConnContext must be set as the http.Server ConnContext so the underlying
+// connection of each request can be found
+func (t *connTracker) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// add tracks the connection of the request, the returned function must be
+// called once the connection is done
+func (t *connTracker) add(r *http.Request) func() {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if conn != nil {
+		t.conns[conn] = struct{}{}
+	}
+	t.wg.Add(1)
+	s, _ := r.Context().Value(slotContextKey{}).(*slot)
+	if s != nil {
+		s.hijacked = true
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.lock.Lock()
+			delete(t.conns, conn)
+			t.lock.Unlock()
+			if s != nil {
+				s.release()
+			}
+			t.wg.Done()
+		})
+	}
+}
+
+// wait blocks until all connections are done or the context is done
+func (t *connTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll force closes all connections
+func (t *connTracker) closeAll() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight answer
+const corsMaxAge = "600"
+
+// cors answers the CORS preflights of the allowed origins itself instead of
+// proxying them, the upstream is never asked. Preflights of other origins
+// get a 403 and any other request goes to the next handler
+type cors struct {
+	next http.Handler
+	// origins are the allowed origins, * allows any
+	origins map[string]bool
+	// headers is the Access-Control-Allow-Headers value, empty allows the
+	// headers the browser asks for
+	headers string
+}
+
+// newCORS returns a cors handler for a comma separated list of origins
+func newCORS(next http.Handler, origins, headers string) *cors {
+	c := &cors{next: next, origins: make(map[string]bool), headers: headers}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			c.origins[o] = true
+		}
+	}
+	return c
+}
+
+// isPreflight reports whether r is a CORS preflight, an OPTIONS request
+// telling the method it is going to be followed by
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (c *cors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isPreflight(r) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !c.origins["*"] && !c.origins[origin] {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	headers := c.headers
+	if headers == "" {
+		headers = r.Header.Get("Access-Control-Request-Headers")
+	}
+	if headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+}
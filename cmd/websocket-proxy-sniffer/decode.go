@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// openStream opens the raw websocket stream of file, or stdin if it is "-",
+// and returns it with the name to log it under. Files whose name ends in .gz
+// are gunzipped
+func openStream(file string) (io.ReadCloser, string, error) {
+	if file == "-" {
+		return ioutil.NopCloser(os.Stdin), "stdin", nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	// as saved by -outdir with -compress
+	if !strings.HasSuffix(file, ".gz") {
+		return f, file, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return &gzipStream{Reader: zr, f: f}, file, nil
+}
+
+// gzipStream closes the file of a gzip reader along with it
+type gzipStream struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipStream) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// decode logs the frames of a raw websocket stream opened by openStream, such
+// as an .in or .out capture, named name. It goes through the same read loop
+// as live connections, masked streams are read as client to server traffic
+// and the others as server to client
+func decode(r io.Reader, name string, masked bool, s *session) error {
+	// the logger expects a request, use the input as the remote address
+	s.req = &http.Request{
+		URL:        &url.URL{Path: name},
+		Header:     http.Header{},
+		RemoteAddr: name,
+	}
+	dir := sniffer.ServerToClient
+	if masked {
+		dir = sniffer.ClientToServer
+	}
+	return s.readLoop(context.Background(), r, dir)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// dialOptions configure how the upstreams are dialed
+type dialOptions struct {
+	insecure bool
+	retries  int
+	backoff  time.Duration
+	// timeout bounds both the tcp dial and the tls handshake
+	timeout time.Duration
+	// keepAlive is the tcp keep alive period, zero disables it
+	keepAlive time.Duration
+}
+
+// dialer returns the function dialing the upstreams, with retries if set
+func (o dialOptions) dialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: o.timeout, KeepAlive: o.keepAlive}
+	if o.keepAlive == 0 {
+		// a zero KeepAlive means the default period to net.Dialer
+		d.KeepAlive = -1
+	}
+	if o.retries == 0 {
+		return d.DialContext
+	}
+	r := &retryDialer{dial: d.DialContext, retries: o.retries, backoff: o.backoff}
+	return r.DialContext
+}
+
+// retryDialer retries failed upstream dials, doubling the wait after every
+// attempt. Only establishing the connection is retried, once it is up any
+// error is final
+type retryDialer struct {
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	retries int
+	backoff time.Duration
+}
+
+func (d *retryDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := d.dial(ctx, network, addr)
+		if err == nil || attempt > d.retries || ctx.Err() != nil {
+			return conn, err
+		}
+		log.Printf("dial %s: %v, retrying in %s (%d/%d)\n", addr, err, wait,
+			attempt, d.retries)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		wait *= 2
+	}
+}
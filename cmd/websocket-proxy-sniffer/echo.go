@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// echoServer is a websocket server that sends every message back, used on
+// -echo instead of proxying so the sniffer can be tried without an upstream
+type echoServer struct{}
+
+func (echoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !sniffer.IsWebSocketUpgrade(r) || key == "" {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	// set before hijacking so the sniffer records them
+	h := w.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", sniffer.AcceptKey(key))
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	// the response goes through the buffered writer, which writes to the
+	// connection below the sniffer as the reverse proxy does, so only frames
+	// are sniffed
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	fr := sniffer.NewFrameReader(conn, true)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		f.Masked = false
+		switch f.Opcode {
+		case sniffer.OpPing:
+			f.Opcode = sniffer.OpPong
+		case sniffer.OpPong:
+			continue
+		}
+		if err := sniffer.WriteFrame(conn, f); err != nil {
+			return
+		}
+		if f.Opcode == sniffer.OpClose {
+			// let the client close the connection, closing it here would
+			// race the sniffer reading the close frames
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// execReplyTimeout is how long the -exec program has to answer a frame
+// before it is considered stuck
+const execReplyTimeout = 5 * time.Second
+
+// execExitTimeout is how long the -exec program has to exit once its stdin
+// is closed before it is killed
+const execExitTimeout = time.Second
+
+// execHook runs the -exec program of a connection. Every data frame is
+// written to its stdin as a json line, like the ones of -format json, and it
+// must answer with a line for each of them: the event with its payload
+// changed, {"drop":true} to drop the frame, or an empty line to keep it as
+// is. Control frames aren't sent, changing them would break the connection.
+// Both directions call it, the lock makes their frames take turns
+type execHook struct {
+	req   *http.Request
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// enc writes the events to stdin, like the json sink does
+	enc   *json.Encoder
+	lines chan string
+	// exited is closed once the program has exited and its output is read
+	exited chan struct{}
+
+	lock sync.Mutex
+	// failed is set once the program can't be used, frames are then
+	// forwarded unchanged
+	failed bool
+}
+
+// execReply is the answer of the program to a frame
+type execReply struct {
+	Payload *string `json:"payload"`
+	Drop    bool    `json:"drop"`
+}
+
+// execLimiter bounds the number of -exec programs running at once
+type execLimiter chan struct{}
+
+func newExecLimiter(max int) execLimiter {
+	return make(execLimiter, max)
+}
+
+// start runs the program for the connection of r, or returns nil if the limit
+// of programs has been reached or it fails to start
+func (l execLimiter) start(command []string, r *http.Request) *execHook {
+	select {
+	case l <- struct{}{}:
+	default:
+		log.Printf("WARNING: %s -exec limit reached, frames won't be passed to it\n",
+			connName(r))
+		return nil
+	}
+	h, err := startExec(command, r)
+	if err != nil {
+		log.Printf("%s -exec: %v\n", connName(r), err)
+		<-l
+		return nil
+	}
+	go func() {
+		<-h.exited
+		<-l
+	}()
+	return h
+}
+
+func startExec(command []string, r *http.Request) (*execHook, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SNIFFER_CONN_ID="+sniffer.ConnID(r), "SNIFFER_REMOTE_ADDR="+r.RemoteAddr,
+		"SNIFFER_URL="+r.URL.String())
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	h := &execHook{req: r, cmd: cmd, stdin: stdin, lines: make(chan string),
+		exited: make(chan struct{})}
+	h.enc = json.NewEncoder(stdin)
+	h.enc.SetEscapeHTML(false)
+	go func() {
+		defer close(h.exited)
+		defer close(h.lines)
+		br := bufio.NewReader(stdout)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				break
+			}
+			h.lines <- strings.TrimRight(line, "\r\n")
+		}
+		// Wait closes stdout, so it must wait for all of it to be read
+		cmd.Wait()
+	}()
+	return h, nil
+}
+
+// onFrame passes f to the program and returns the frame it answers with
+func (h *execHook) onFrame(dir sniffer.Direction, f *sniffer.Frame) *sniffer.Frame {
+	if f.Opcode.IsControl() {
+		return f
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.failed {
+		return f
+	}
+	f, err := h.exchange(dir, f)
+	if err != nil {
+		log.Printf("%s -exec: %v, frames won't be passed to it anymore\n",
+			connName(h.req), err)
+		h.failed = true
+		h.cmd.Process.Kill()
+	}
+	return f
+}
+
+// exchange must be called with the lock held, on error f is returned as is
+func (h *execHook) exchange(dir sniffer.Direction, f *sniffer.Frame) (*sniffer.Frame, error) {
+	ev := sniffer.NewFrameEvent(h.req, dir, f, time.Now())
+	ev.Frame = nil
+	if err := h.enc.Encode(ev); err != nil {
+		return f, err
+	}
+	var line string
+	select {
+	case l, ok := <-h.lines:
+		if !ok {
+			return f, errors.New("program exited")
+		}
+		line = l
+	case <-time.After(execReplyTimeout):
+		return f, fmt.Errorf("no answer in %s", execReplyTimeout)
+	}
+	if line == "" {
+		return f, nil
+	}
+	var reply execReply
+	if err := json.Unmarshal([]byte(line), &reply); err != nil {
+		return f, fmt.Errorf("invalid answer: %w", err)
+	}
+	if reply.Drop {
+		return nil, nil
+	}
+	if reply.Payload == nil {
+		return f, nil
+	}
+	// the payload is encoded as in the events it was given
+	payload := []byte(*reply.Payload)
+	if f.Opcode != sniffer.OpText || f.Rsv != 0 {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(*reply.Payload); err != nil {
+			return f, fmt.Errorf("invalid answer payload: %w", err)
+		}
+	}
+	f.Payload = payload
+	return f, nil
+}
+
+// close closes the stdin of the program and kills it if it doesn't exit soon
+func (h *execHook) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stdin.Close()
+	exited := make(chan struct{})
+	go func() {
+		// drain so the program doesn't block writing answers nobody reads
+		for range h.lines {
+		}
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(execExitTimeout):
+		h.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// peerAddrKey holds the address of the peer that sent a request whose
+// RemoteAddr was replaced by the client address in its forwarding headers
+type peerAddrKey struct{}
+
+// trustForwarded replaces the RemoteAddr of the requests with the client
+// address in their Forwarded or X-Forwarded-For headers, so logs and
+// captures name the client instead of the proxy in front of the sniffer.
+// Only the last address is used, it is the one added by that proxy, the
+// ones before it could have been made up by the client
+func trustForwarded(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr := forwardedAddr(r.Header, r.RemoteAddr); addr != "" {
+			ctx := context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)
+			r = r.WithContext(ctx)
+			r.RemoteAddr = addr
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// restorePeer gives back their peer RemoteAddr to the requests changed by
+// trustForwarded, so the reverse proxy appends the proxy in front to
+// X-Forwarded-For rather than the client a second time
+func restorePeer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = peer
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// forwardedAddr returns the client address of the last hop in the Forwarded
+// header or, if there is none, in X-Forwarded-For. The port of peer is used
+// when the header doesn't have one. It returns an empty string if there is
+// no usable address
+func forwardedAddr(h http.Header, peer string) string {
+	_, port, _ := net.SplitHostPort(peer)
+	var node string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, param := range strings.Split(lastElement(values), ";") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				node = strings.Trim(kv[1], `"`)
+			}
+		}
+	} else {
+		node = strings.TrimSpace(lastElement(h.Values("X-Forwarded-For")))
+	}
+	host := node
+	if strings.HasPrefix(node, "[") || strings.Count(node, ":") == 1 {
+		var p string
+		var err error
+		if host, p, err = net.SplitHostPort(node); err != nil {
+			// a bracketed IPv6 address without a port
+			host = strings.Trim(node, "[]")
+		} else {
+			port = p
+		}
+	}
+	if net.ParseIP(host) == nil {
+		// unknown, obfuscated identifiers and garbage
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// lastElement returns the last comma separated element of the header values
+func lastElement(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	elems := strings.Split(values[len(values)-1], ",")
+	return elems[len(elems)-1]
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// sensitiveHeaders are masked in handshake dumps when -redact is set
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// dumpHandshake writes the request line and headers of the client handshake
+// and the response sent back, as they look on the wire. With a redactor the
+// credentials are masked and its rules are applied to the other values
+func dumpHandshake(w io.Writer, r *http.Request, hs *sniffer.Handshake,
+	redact *redactor) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	fmt.Fprintf(&b, "Host: %s\n", r.Host)
+	writeHeaders(&b, redact.headers(r.Header))
+	fmt.Fprintf(&b, "\nHTTP/1.1 %d %s\n", http.StatusSwitchingProtocols,
+		http.StatusText(http.StatusSwitchingProtocols))
+	writeHeaders(&b, redact.headers(hs.Header))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHeaders(b *strings.Builder, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Fprintf(b, "%s: %s\n", name, v)
+		}
+	}
+}
+
+// headers returns a copy of h with the credentials masked and the rules
+// applied to the other values, a nil redactor returns h as it is
+func (r *redactor) headers(h http.Header) http.Header {
+	if r == nil {
+		return h
+	}
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			if isSensitiveHeader(name) {
+				v = redactMask
+			} else {
+				v = string(r.redact([]byte(v)))
+			}
+			out[name] = append(out[name], v)
+		}
+	}
+	return out
+}
+
+// frame returns a copy of f with its payload redacted if it is a text
+// message, a nil redactor returns f as it is
+func (r *redactor) frame(f *sniffer.Frame) *sniffer.Frame {
+	if r == nil || f.Opcode != sniffer.OpText {
+		return f
+	}
+	c := *f
+	c.Payload = r.redact(f.Payload)
+	return &c
+}
+
+func isSensitiveHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, s := range sensitiveHeaders {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeCookies returns the cookies the client sent and the server set in
+// the handshake as name=value. With a redactor only the names are kept, the
+// values are credentials more often than not
+func handshakeCookies(r *http.Request, hs *sniffer.Handshake,
+	redact *redactor) (sent, set []string) {
+	format := func(c *http.Cookie) string {
+		if redact != nil {
+			return c.Name + "=" + redactMask
+		}
+		return c.Name + "=" + c.Value
+	}
+	for _, c := range r.Cookies() {
+		sent = append(sent, format(c))
+	}
+	res := &http.Response{Header: hs.Header}
+	for _, c := range res.Cookies() {
+		set = append(set, format(c))
+	}
+	return sent, set
+}
+
+// checkAccept warns when the server answered the handshake with a
+// Sec-WebSocket-Accept that doesn't match the key the client sent, which a
+// client should refuse
+func checkAccept(r *http.Request, hs *sniffer.Handshake, sum *summary) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	accept := hs.Header.Get("Sec-WebSocket-Accept")
+	if sniffer.ValidAccept(key, accept) {
+		return
+	}
+	log.Printf("WARNING: %s Sec-WebSocket-Accept %q doesn't match the key %q, "+
+		"violates RFC 6455\n", connName(r), accept, key)
+	metrics.AddViolation("invalid_accept")
+	sum.addViolation()
+}
+
+// rejectedBodyMax is how much of the body of a rejected upgrade is logged
+const rejectedBodyMax = 512
+
+// logRejectedUpgrade logs the websocket upgrades the upstream answers with
+// anything but a 101, which are sent back to the client as they are and
+// never hijacked. The start of the body is logged too, it usually tells why,
+// and put back so the client gets all of it
+func logRejectedUpgrade(res *http.Response) {
+	req := res.Request
+	if req == nil || res.StatusCode == http.StatusSwitchingProtocols ||
+		!sniffer.IsWebSocketUpgrade(req) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, rejectedBodyMax))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+	if err != nil {
+		log.Printf("%s upgrade rejected by upstream %s: %s, body: %v\n",
+			req.RemoteAddr, req.URL.Host, res.Status, err)
+		return
+	}
+	log.Printf("%s upgrade rejected by upstream %s: %s %q\n", req.RemoteAddr,
+		req.URL.Host, res.Status, body)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// harRecorder collects the hijacked connections as HAR entries, messages are
+// recorded with the _webSocketMessages extension used by Chrome DevTools
+type harRecorder struct {
+	// redact, if set, applies to the handshake headers, the messages are
+	// recorded once redacted by the session
+	redact  *redactor
+	lock    sync.Mutex
+	entries []*harEntry
+}
+
+type harEntry struct {
+	lock     sync.Mutex
+	started  time.Time
+	ended    time.Time
+	req      *http.Request
+	messages []harMessage
+}
+
+type harMessage struct {
+	Type string `json:"type"`
+	// Time is in seconds since the epoch
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newHarRecorder(redact *redactor) *harRecorder {
+	return &harRecorder{redact: redact}
+}
+
+// add starts an entry for a hijacked request
+func (h *harRecorder) add(r *http.Request) *harEntry {
+	e := &harEntry{started: time.Now(), req: r}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, e)
+	return e
+}
+
+// add records a message, it does nothing on a nil entry
+func (e *harEntry) add(dir sniffer.Direction, f *sniffer.Frame) {
+	if e == nil {
+		return
+	}
+	m := harMessage{
+		Type:   "send",
+		Time:   float64(time.Now().UnixNano()) / 1e9,
+		Opcode: int(f.Opcode),
+	}
+	if dir == sniffer.ServerToClient {
+		m.Type = "receive"
+	}
+	if f.Opcode == sniffer.OpText {
+		m.Data = string(f.Payload)
+	} else {
+		m.Data = base64.StdEncoding.EncodeToString(f.Payload)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.messages = append(e.messages, m)
+}
+
+// close marks the end of the connection
+func (e *harEntry) close() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.ended = time.Now()
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+	return headers
+}
+
+// WriteTo writes the HAR document, it should be called once all connections
+// are done
+func (h *harRecorder) WriteTo(w io.Writer) (int64, error) {
+	type object = map[string]interface{}
+	h.lock.Lock()
+	entries := make([]object, 0, len(h.entries))
+	for _, e := range h.entries {
+		e.lock.Lock()
+		ended := e.ended
+		if ended.IsZero() {
+			ended = time.Now()
+		}
+		scheme := "ws"
+		if e.req.TLS != nil {
+			scheme = "wss"
+		}
+		entries = append(entries, object{
+			"startedDateTime": e.started.Format(time.RFC3339Nano),
+			"time":            float64(ended.Sub(e.started)) / float64(time.Millisecond),
+			"request": object{
+				"method":      e.req.Method,
+				"url":         scheme + "://" + e.req.Host + e.req.URL.RequestURI(),
+				"httpVersion": e.req.Proto,
+				"headers":     harHeaders(h.redact.headers(e.req.Header)),
+				"queryString": []harNameValue{},
+				"cookies":     []harNameValue{},
+				"headersSize": -1,
+				"bodySize":    0,
+			},
+			"response": object{
+				"status":      http.StatusSwitchingProtocols,
+				"statusText":  http.StatusText(http.StatusSwitchingProtocols),
+				"httpVersion": "HTTP/1.1",
+				"headers":     harHeaders(h.redact.headers(sniffer.ResponseHeader(e.req))),
+				"cookies":     []harNameValue{},
+				"content":     object{"size": 0, "mimeType": ""},
+				"redirectURL": "",
+				"headersSize": -1,
+				"bodySize":    0,
+			},
+			"cache":              object{},
+			"timings":            object{"send": 0, "wait": 0, "receive": 0},
+			"_resourceType":      "websocket",
+			"_webSocketMessages": append([]harMessage{}, e.messages...),
+		})
+		e.lock.Unlock()
+	}
+	h.lock.Unlock()
+
+	doc := object{
+		"log": object{
+			"version": "1.2",
+			"creator": object{
+				"name":    "websocket-proxy-sniffer",
+				"version": "0.1",
+			},
+			"entries": entries,
+		},
+	}
+	cw := &countWriter{w: w}
+	enc := json.NewEncoder(cw)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(doc)
+	return cw.n, err
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// handshakeHeaders can't be set with -set-header, the upgrade relies on them
+var handshakeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+}
+
+// headerRewrite sets headers of the handshake requests, an empty value
+// removes the header
+type headerRewrite struct {
+	name  string
+	value string
+}
+
+// parseHeaderRewrite parses name=value
+func parseHeaderRewrite(s string) (headerRewrite, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return headerRewrite{}, fmt.Errorf("invalid header %q: expected name=value", s)
+	}
+	name := http.CanonicalHeaderKey(strings.TrimSpace(s[:i]))
+	for _, h := range handshakeHeaders {
+		if name == h {
+			return headerRewrite{}, fmt.Errorf("header %s can't be set, "+
+				"the websocket handshake needs it", name)
+		}
+	}
+	return headerRewrite{name: name, value: s[i+1:]}, nil
+}
+
+// apply rewrites the headers of h
+func (hr headerRewrite) apply(h http.Header) {
+	if hr.value == "" {
+		h.Del(hr.name)
+		return
+	}
+	h.Set(hr.name, hr.value)
+}
+
+// originRewrite replaces the origin of the handshake requests. Old drafts of
+// the protocol, still accepted by some servers, send it as
+// Sec-WebSocket-Origin instead, which would contradict the new one
+func originRewrite(origin string) []headerRewrite {
+	return []headerRewrite{
+		{name: "Origin", value: origin},
+		{name: "Sec-Websocket-Origin"},
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// historyMax is the largest -history, along with historyPayloadMax it bounds
+// the memory held by each connection
+const historyMax = 1000
+
+// historyPayloadMax is how much of each payload the history keeps
+const historyPayloadMax = 1024
+
+// history keeps the last server messages of a connection, on -history, to
+// dump them when it closes abnormally. Only the server read loop adds to it
+// and it is dumped once the loop is done, so it needs no lock. Its methods
+// are no-ops on a nil receiver
+type history struct {
+	frames []historyFrame
+	// next is where the next frame goes, once frames is full it is also the
+	// oldest one
+	next int
+	full bool
+}
+
+type historyFrame struct {
+	at     time.Time
+	opcode sniffer.Opcode
+	rsv    byte
+	length int
+	// payload is cut to historyPayloadMax
+	payload []byte
+}
+
+func newHistory(n int) *history {
+	return &history{frames: make([]historyFrame, n)}
+}
+
+func (h *history) add(f *sniffer.Frame) {
+	if h == nil {
+		return
+	}
+	p := f.Payload
+	if len(p) > historyPayloadMax {
+		p = p[:historyPayloadMax]
+	}
+	h.frames[h.next] = historyFrame{
+		at:      time.Now(),
+		opcode:  f.Opcode,
+		rsv:     f.Rsv,
+		length:  len(f.Payload),
+		payload: append([]byte(nil), p...),
+	}
+	h.next++
+	if h.next == len(h.frames) {
+		h.next, h.full = 0, true
+	}
+}
+
+// dump logs the frames kept, oldest first
+func (h *history) dump(r *http.Request, reason string) {
+	if h == nil {
+		return
+	}
+	frames := h.frames[:h.next]
+	if h.full {
+		frames = append(append([]historyFrame(nil), h.frames[h.next:]...), frames...)
+	}
+	log.Printf("%s %s, last %d server messages:\n", connName(r), reason, len(frames))
+	for _, f := range frames {
+		var payload string
+		if f.opcode == sniffer.OpText && f.rsv == 0 {
+			payload = fmt.Sprintf("%q", f.payload)
+		} else {
+			payload = hex.EncodeToString(f.payload)
+		}
+		if omitted := f.length - len(f.payload); omitted > 0 {
+			payload += fmt.Sprintf("…(+%d bytes)", omitted)
+		}
+		log.Printf("  %s %s %s\n", f.at.Format(sniffer.TimeFormat), f.opcode, payload)
+	}
+}
+
+// abnormalClose returns why ev is an abnormal close, a close frame with any
+// status but 1000 or none at all, or "" if it isn't
+func abnormalClose(ev sniffer.ConnEvent) string {
+	switch ev.CloseCode {
+	case 1000:
+		return ""
+	case 0:
+		return "closed without a close frame"
+	}
+	return fmt.Sprintf("closed with status %d", ev.CloseCode)
+}
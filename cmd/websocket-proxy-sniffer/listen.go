@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// listenSpec is a -listen value, addr[,cert=file,key=file]. Listeners with
+// a certificate serve tls, the others use -cert and -key if set
+type listenSpec struct {
+	addr string
+	cert string
+	key  string
+}
+
+func parseListen(s string) (listenSpec, error) {
+	parts := strings.Split(s, ",")
+	l := listenSpec{addr: parts[0]}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("invalid -listen option %q, must be name=value", p)
+		}
+		switch kv[0] {
+		case "cert":
+			l.cert = kv[1]
+		case "key":
+			l.key = kv[1]
+		default:
+			return l, fmt.Errorf("unknown -listen option %q", kv[0])
+		}
+	}
+	if l.addr == "" {
+		return l, fmt.Errorf("-listen %q has no address", s)
+	}
+	if (l.cert == "") != (l.key == "") {
+		return l, fmt.Errorf("-listen %s needs both cert and key to serve tls", l.addr)
+	}
+	return l, nil
+}
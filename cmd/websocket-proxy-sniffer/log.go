@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// frameLogger is called for every captured frame
+type frameLogger func(req *http.Request, dir sniffer.Direction, f *sniffer.Frame)
+
+// verbosity levels of the -v flag
+const (
+	// verbosityErrors only logs errors and connections opening and closing
+	verbosityErrors = iota
+	// verbositySummary logs every frame without its payload
+	verbositySummary
+	// verbosityPayload logs every frame with its payload
+	verbosityPayload
+)
+
+// frameLog serializes the frames of all connections into a single sink.
+// Timestamps are taken while holding the lock, so events are written in the
+// order frames crossed the proxy and their times never go backwards
+type frameLog struct {
+	lock sync.Mutex
+	sink sniffer.Sink
+	utc  bool
+	// summary leaves payloads out
+	summary bool
+	// headers logs the header of each frame instead of the payload, on
+	// -headers-only
+	headers bool
+}
+
+// setLogOutput sends the log package output to the given file, opened for
+// appending so it can be rotated by moving it away, or to syslog, which does
+// its own timestamping. With neither set the log is left on stderr
+func setLogOutput(path string, useSyslog bool) error {
+	switch {
+	case path != "" && useSyslog:
+		return errors.New("-log and -syslog can't be used together")
+	case useSyslog:
+		w, err := newSyslog()
+		if err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	case path != "":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+// parseDirection returns which directions the -direction flag selects,
+// indexed by sniffer.Direction
+func parseDirection(s string) ([2]bool, error) {
+	switch s {
+	case "both":
+		return [2]bool{true, true}, nil
+	case "in":
+		return [2]bool{sniffer.ClientToServer: true}, nil
+	case "out":
+		return [2]bool{sniffer.ServerToClient: true}, nil
+	}
+	return [2]bool{}, fmt.Errorf("unknown direction %q, must be both, in or out", s)
+}
+
+// opcodeNames are the frame types -opcode selects
+var opcodeNames = map[string]sniffer.Opcode{
+	"text":   sniffer.OpText,
+	"binary": sniffer.OpBinary,
+	"close":  sniffer.OpClose,
+	"ping":   sniffer.OpPing,
+	"pong":   sniffer.OpPong,
+}
+
+// parseOpcodes returns the frame types in the comma separated list of the
+// -opcode flag, or nil if it is empty so every type is logged
+func parseOpcodes(s string) (map[sniffer.Opcode]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ops := make(map[sniffer.Opcode]bool)
+	for _, name := range strings.Split(s, ",") {
+		op, ok := opcodeNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %q, must be text, binary, "+
+				"close, ping or pong", name)
+		}
+		ops[op] = true
+	}
+	return ops, nil
+}
+
+// connName is how the log names the connection of r, its address followed by
+// its id
+func connName(r *http.Request) string {
+	if id := sniffer.ConnID(r); id != "" {
+		return r.RemoteAddr + " #" + id
+	}
+	return r.RemoteAddr
+}
+
+func newFrameLog(sink sniffer.Sink, utc bool) *frameLog {
+	return &frameLog{sink: sink, utc: utc}
+}
+
+// frameLogger returns the logger of frames at the given verbosity level.
+// Nothing is logged at verbosityErrors
+func (l *frameLog) frameLogger(verbosity int) frameLogger {
+	if verbosity <= verbosityErrors {
+		return func(*http.Request, sniffer.Direction, *sniffer.Frame) {}
+	}
+	l.summary = verbosity < verbosityPayload
+	return l.log
+}
+
+// logConn writes a connection event, at every verbosity level, if the sink
+// records connections
+func (l *frameLog) logConn(ev sniffer.ConnEvent) {
+	cs, ok := l.sink.(sniffer.ConnSink)
+	if !ok {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ev.Time = l.now()
+	if err := cs.WriteConn(ev); err != nil {
+		log.Println(err)
+	}
+}
+
+// now must be called with the lock held
+func (l *frameLog) now() time.Time {
+	now := time.Now().Round(0).Truncate(time.Microsecond)
+	if l.utc {
+		return now.UTC()
+	}
+	return now.Local()
+}
+
+func (l *frameLog) log(req *http.Request, dir sniffer.Direction, f *sniffer.Frame) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ev := sniffer.NewFrameEvent(req, dir, f, l.now())
+	if l.headers {
+		ev.Header = sniffer.NewFrameHeader(f)
+		ev.CloseCode, ev.CloseReason = 0, ""
+	}
+	if l.summary || l.headers {
+		ev.Payload, ev.Frame = "", nil
+	}
+	if err := l.sink.WriteFrame(ev); err != nil {
+		log.Println(err)
+	}
+}
+
+// colorMode reports whether the log written to f should be colored for the
+// given -color mode, auto means only if f is a terminal
+func colorMode(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		fi, err := f.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("unknown color mode %q", mode)
+	}
+}
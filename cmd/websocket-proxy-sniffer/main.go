@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// metrics is nil unless -metrics is set, Metrics methods are no-ops on a nil
+// receiver so callers don't need to check
+var metrics *sniffer.Metrics
+
+func main() {
+	cfg := defaultConfig()
+	cfg.applyEnv(os.Getenv)
+	flag.StringVar(&cfg.Target, "target", cfg.Target,
+		"upstream websocket server (ws, wss, http or https), or $SNIFFER_TARGET")
+	flag.StringVar(&cfg.Mode, "mode", cfg.Mode, "proxy mode, reverse sends "+
+		"requests to -target or -route and transparent to the host each client asks for")
+	flag.Var((*stringsFlag)(&cfg.Routes), "route", "route requests by host or "+
+		"/path prefix to an upstream as match=url, can be repeated and overrides -target")
+	flag.Var((*stringsFlag)(&cfg.Listens), "listen", "address to listen on, "+
+		"paths or unix:path mean a unix socket, ,cert=file,key=file serves tls "+
+		"on it, can be repeated, default $SNIFFER_LISTEN or "+cfg.Listen)
+	flag.StringVar(&cfg.CORSOrigin, "cors-origin", "", "answer the CORS "+
+		"preflights of these comma separated origins, or * for any, instead of proxying them")
+	flag.StringVar(&cfg.CORSHeaders, "cors-headers", "", "Access-Control-Allow-Headers "+
+		"of the -cors-origin answers, default the headers asked for")
+	flag.BoolVar(&cfg.Insecure, "insecure", false,
+		"skip tls certificate verification of the upstream")
+	flag.StringVar(&cfg.Cert, "cert", "", "tls certificate file to serve wss")
+	flag.StringVar(&cfg.Key, "key", "", "tls key file to serve wss")
+	flag.StringVar(&cfg.Format, "format", cfg.Format,
+		"frame log format, text or json, or $SNIFFER_FORMAT")
+	flag.BoolVar(&cfg.UTC, "utc", false, "log frame timestamps in UTC")
+	flag.BoolVar(&cfg.Pretty, "pretty", false,
+		"indent text messages holding json, needs -format text")
+	flag.StringVar(&cfg.Binary, "binary", cfg.Binary, "binary payload "+
+		"rendering, hex, base64 or hexdump, needs -format text")
+	flag.StringVar(&cfg.Color, "color", cfg.Color, "color the text log by "+
+		"direction and opcode, auto only does it when stdout is a terminal, always or never")
+	flag.IntVar(&cfg.MaxLogBytes, "max-log-bytes", 0, "truncate logged "+
+		"payloads longer than this, once decoded, 0 logs them whole")
+	flag.StringVar(&cfg.Outdir, "outdir", "",
+		"directory to save the raw traffic of each connection, with -route in "+
+			"a subdirectory per upstream host")
+	flag.BoolVar(&cfg.Compress, "compress", false, "gzip the -outdir captures, "+
+		"saved as .in.gz and .out.gz")
+	flag.BoolVar(&cfg.NDJSON, "ndjson", false, "also save the frames of each "+
+		"-outdir capture with their time to a .ndjson file, which -replay reads. "+
+		"With -redact it has the messages once redacted instead")
+	flag.StringVar(&cfg.Pcap, "pcap", "", "file to write captures as pcap")
+	flag.DurationVar(&cfg.FlushInterval, "flush-interval", cfg.FlushInterval,
+		"how often buffered -outdir and -pcap captures are written to disk")
+	flag.StringVar(&cfg.Publish, "publish", "", "also send every event as a "+
+		"json datagram to udp://host:port or unixgram:///path, for live tools, "+
+		"events are dropped rather than slowing the proxy")
+	flag.StringVar(&cfg.MetricsListen, "metrics", "",
+		"address to serve prometheus metrics on /metrics")
+	flag.StringVar(&cfg.AdminListen, "admin-listen", "", "address to serve "+
+		"the admin endpoint on, which shows connection stats and injects frames")
+	flag.DurationVar(&cfg.PingWindow, "ping-window", cfg.PingWindow,
+		"time to wait for the pong of a ping to measure latency")
+	flag.IntVar(&cfg.BufSize, "bufsize", cfg.BufSize,
+		"read buffer size of the frame parser")
+	flag.Uint64Var(&cfg.MaxFrame, "max-frame", cfg.MaxFrame,
+		"maximum frame payload in bytes, larger frames close the connection")
+	flag.Uint64Var(&cfg.MaxMessage, "max-message", cfg.MaxMessage,
+		"maximum payload in bytes of a message reassembled from fragments, "+
+			"larger messages close the connection, 0 means no limit")
+	flag.StringVar(&cfg.Filter, "filter", "",
+		"only log frames whose payload matches this regular expression")
+	flag.BoolVar(&cfg.HeadersOnly, "headers-only", false, "log the header of "+
+		"every frame, fin, rsv, mask and length, instead of the messages "+
+		"and their payloads")
+	flag.StringVar(&cfg.Opcode, "opcode", "", "only log these comma separated "+
+		"frame types: text, binary, close, ping or pong, default all of them")
+	flag.Float64Var(&cfg.Sample, "sample", cfg.Sample, "fraction of data "+
+		"frames to log, from 0 to 1, control frames are always logged")
+	flag.Int64Var(&cfg.SampleSeed, "sample-seed", 0, "seed of the -sample "+
+		"choices, 0 picks a random one")
+	flag.BoolVar(&cfg.TrustXFF, "trust-xff", false, "log the client address "+
+		"in the Forwarded or X-Forwarded-For headers, only for a sniffer "+
+		"behind a proxy that sets them")
+	flag.Var((*stringsFlag)(&cfg.AllowCIDR), "allow-cidr", "only sniff the "+
+		"clients in these comma separated networks, such as 10.0.0.0/8 or "+
+		"fd00::/8, can be repeated")
+	flag.Var((*stringsFlag)(&cfg.DenyCIDR), "deny-cidr", "don't sniff the "+
+		"clients in these comma separated networks, even if allowed by "+
+		"-allow-cidr, can be repeated")
+	flag.StringVar(&cfg.DenyAction, "deny-action", cfg.DenyAction, "what to "+
+		"do with the clients not sniffed by -allow-cidr and -deny-cidr, proxy "+
+		"them or reject them with a 403")
+	flag.StringVar(&cfg.Direction, "direction", cfg.Direction, "frames to log "+
+		"and save to -outdir, both, in for client to server or out for server to client")
+	flag.StringVar(&cfg.Exec, "exec", "", "program run for every connection "+
+		"that gets its data frames as json lines on stdin and answers each "+
+		"with a line on stdout, to change or drop them")
+	flag.IntVar(&cfg.ExecMax, "exec-max", cfg.ExecMax,
+		"maximum -exec programs running at once")
+	flag.Float64Var(&cfg.AlertFPS, "alert-fps", 0, "warn when a connection "+
+		"sends more frames per second than this in either direction, 0 disables it")
+	flag.DurationVar(&cfg.AlertWindow, "alert-window", cfg.AlertWindow,
+		"time over which the -alert-fps rate is measured")
+	flag.StringVar(&cfg.Replay, "replay", "",
+		"send the client frames of a .in or .ndjson capture to -target and exit")
+	flag.BoolVar(&cfg.Realtime, "realtime", false,
+		"respect the original timing of the frames on -replay, only .ndjson "+
+			"captures have it")
+	flag.StringVar(&cfg.Connect, "connect", "", "connect to this websocket "+
+		"url as a client, instead of proxying, and log the frames of the server")
+	flag.StringVar(&cfg.Send, "send", "",
+		"text message -connect sends once connected")
+	flag.StringVar(&cfg.Decode, "decode", "", "log the frames of a raw "+
+		"websocket stream read from this file, or - for stdin, and exit")
+	flag.BoolVar(&cfg.Masked, "masked", false, "the -decode input is client "+
+		"to server traffic, whose frames are masked")
+	flag.IntVar(&cfg.MaxConns, "max-conns", 0,
+		"maximum concurrent connections, zero means no limit")
+	flag.IntVar(&cfg.RateIn, "rate-limit-in", 0,
+		"client to server bytes per second, zero means no limit")
+	flag.IntVar(&cfg.RateOut, "rate-limit-out", 0,
+		"server to client bytes per second, zero means no limit")
+	flag.BoolVar(&cfg.RateGlobal, "rate-limit-global", false,
+		"share the rate limits between all connections")
+	flag.IntVar(&cfg.History, "history", 0, "keep the last messages of the "+
+		"server of every connection, up to 1000, and log them when it closes "+
+		"with a status other than 1000 or without a close frame")
+	flag.StringVar(&cfg.Har, "har", "",
+		"file to write the captured sessions as HAR on shutdown")
+	flag.IntVar(&cfg.UpstreamRetries, "upstream-retries", 0,
+		"times a failed upstream dial is retried")
+	flag.DurationVar(&cfg.UpstreamBackoff, "upstream-backoff", cfg.UpstreamBackoff,
+		"wait before the first upstream retry, doubled after every attempt")
+	flag.DurationVar(&cfg.DialTimeout, "dial-timeout", cfg.DialTimeout,
+		"timeout to connect to an upstream, including the tls handshake")
+	flag.DurationVar(&cfg.KeepAlive, "keepalive", cfg.KeepAlive,
+		"tcp keep alive period of the upstream connections, 0 disables it")
+	flag.IntVar(&cfg.Verbosity, "v", cfg.Verbosity, "verbosity, 0 logs "+
+		"errors and connections, 1 adds frame summaries and 2 adds payloads")
+	flag.BoolVar(&cfg.HTTP2, "http2", false, "accept websockets over HTTP/2 "+
+		"(RFC 8441), requires -cert and GODEBUG=http2xconnect=1")
+	flag.StringVar(&cfg.Mirror, "mirror", "", "shadow upstream that gets a "+
+		"copy of the client messages, its responses are logged and compared "+
+		"with the primary ones but never reach the client")
+	flag.Var((*stringsFlag)(&cfg.SetHeaders), "set-header", "set a header of "+
+		"the handshake sent upstream as name=value, an empty value removes it, "+
+		"can be repeated")
+	origin := flag.String("origin", "", "override the Origin of the handshake "+
+		"sent upstream, an empty value removes it")
+	flag.Var((*stringsFlag)(&cfg.Redact), "redact", "replace matches in text "+
+		"payloads with *** before logging or saving them, a regexp or a json "+
+		"path like $.a.b or $..name, can be repeated. The raw bytes of -pcap "+
+		"and of the -outdir .in and .out files can't be redacted, -outdir "+
+		"only saves the -ndjson file with it")
+	flag.BoolVar(&cfg.Echo, "echo", false, "answer websockets with a local "+
+		"echo server instead of proxying them, -target is ignored")
+	flag.BoolVar(&cfg.ReadyProbe, "ready-probe", false, "make /readyz on "+
+		"-admin-listen perform a websocket handshake with every upstream")
+	flag.BoolVar(&cfg.Readonly, "readonly", false, "guarantee the frames are "+
+		"proxied byte for byte, refusing the flags that change or inject them")
+	flag.BoolVar(&cfg.Check, "check", false, "perform a websocket handshake "+
+		"with every upstream and exit, non zero if any of them fails")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "close websocket "+
+		"connections without traffic for this long, 0 disables it")
+	flag.DurationVar(&cfg.HeaderTimeout, "header-timeout", 0, "close "+
+		"connections whose client takes longer than this to send a frame "+
+		"header once it has started it, 0 disables it")
+	flag.BoolVar(&cfg.Strict, "strict", false, "answer websocket upgrades "+
+		"that can't be sniffed with a 500 instead of proxying them")
+	flag.BoolVar(&cfg.Handshake, "handshake", false, "log the handshake "+
+		"request and response of every connection, also saved to -outdir")
+	flag.BoolVar(&cfg.CountOnly, "count-only", false, "only count the frames "+
+		"and bytes of each direction and opcode, payloads aren't parsed nor "+
+		"logged, to measure throughput")
+	flag.DurationVar(&cfg.StatsInterval, "stats-interval", cfg.StatsInterval,
+		"how often -count-only logs the counts")
+	flag.BoolVar(&cfg.Summary, "summary", false,
+		"write a summary of the traffic to stderr on exit")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout,
+		"time to let connections drain before closing them on shutdown")
+	flag.StringVar(&cfg.Log, "log", "", "file to append the operational log "+
+		"to instead of stderr, frames are still written to stdout")
+	flag.BoolVar(&cfg.Syslog, "syslog", false,
+		"send the operational log to the local syslog daemon")
+	flag.Parse()
+	// an empty -origin removes the header, unlike no -origin
+	if flagSet("origin") {
+		cfg.Origin = origin
+	}
+
+	if err := setLogOutput(cfg.Log, cfg.Syslog); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if flagSet("stats-interval") && !cfg.CountOnly {
+		log.Fatal("-stats-interval needs -count-only")
+	}
+	// the http2 server only accepts extended CONNECT with this setting
+	if cfg.HTTP2 && !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		log.Fatal("-http2 requires the GODEBUG=http2xconnect=1 environment variable")
+	}
+	specs, err := cfg.listenSpecs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.MetricsListen != "" {
+		metrics = sniffer.NewMetrics()
+		sniffer.SetMetrics(metrics)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.MetricsListen, mux))
+		}()
+	}
+	switch {
+	case cfg.Replay != "", cfg.Connect != "", cfg.Decode != "", cfg.Check:
+		if err := runClient(&cfg); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	p, err := NewProxy(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if p.admin != nil {
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.AdminListen, p.admin))
+		}()
+	}
+	if p.stats != nil {
+		go p.logStats(cfg.StatsInterval)
+	}
+	// every listener gets its own server, they all share the proxy and so
+	// the capture pipeline
+	var servers []*http.Server
+	var limited net.Listener
+	for _, l := range specs {
+		ln, err := listen(l.addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheme := "ws"
+		if l.cert != "" {
+			scheme = "wss"
+		}
+		log.Printf("listening on %s %s (%s)\n", ln.Addr().Network(), ln.Addr(), scheme)
+		// -rate-limit-global shares the limits between all listeners too
+		if ll, ok := limited.(*limitedListener); ok {
+			ln = ll.share(ln)
+		} else {
+			ln = newLimitedListener(ln, cfg.RateIn, cfg.RateOut, cfg.RateGlobal)
+			limited = ln
+		}
+		srv := &http.Server{
+			Handler:     p,
+			ConnContext: p.ConnContext,
+		}
+		servers = append(servers, srv)
+		go func(l listenSpec) {
+			var err error
+			if l.cert != "" {
+				err = srv.ServeTLS(ln, l.cert, l.key)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(l)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println(err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	p.Shutdown(ctx)
+}
+
+// runClient runs the modes that don't proxy: -replay, -connect, -decode and
+// -check. Errors are logged
+func runClient(cfg *Config) error {
+	transport := newTransport(cfg.dialOptions())
+	if cfg.Check {
+		rts, err := cfg.routes()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		targets := make([]*url.URL, 0, len(rts))
+		for _, rt := range rts {
+			targets = append(targets, rt.target)
+		}
+		return check(context.Background(), transport, targets)
+	}
+	ls, err := newLogSettings(cfg)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	switch {
+	case cfg.Replay != "":
+		u, err := parseTarget(cfg.Target)
+		if err == nil {
+			err = replay(context.Background(), transport, u, cfg.Replay,
+				cfg.Realtime, ls.logFrame, ls.redact)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		return err
+	case cfg.Connect != "":
+		u, err := parseTarget(cfg.Connect)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			cancel()
+		}()
+		if err := connect(ctx, transport, u, cfg.Send, ls.newSession(cfg, nil), ls.frames); err != nil {
+			log.Println(err)
+			return err
+		}
+		return nil
+	default:
+		r, name, err := openStream(cfg.Decode)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer r.Close()
+		// the read loop logs its own errors
+		return decode(r, name, cfg.Masked, ls.newSession(cfg, nil))
+	}
+}
+
+func writeHar(file string, har *harRecorder) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := har.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newPcapConn starts recording a hijacked request in the pcap file
+func newPcapConn(pw *sniffer.PcapWriter, r *http.Request) (*sniffer.PcapConn, error) {
+	var server string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		server = addr.String()
+	}
+	c, err := pw.Conn(r.RemoteAddr, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.WriteHandshake(r); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// listen creates a tcp listener or a unix one if addr looks like a path
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	case strings.HasPrefix(addr, "/"):
+		return net.Listen("unix", addr)
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// newTransport returns the transport used to dial the upstreams, the tls
+// server name is taken from each target host
+func newTransport(o dialOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// websocket upgrades are only defined for HTTP/1.1
+	t.ForceAttemptHTTP2 = false
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: o.insecure}
+	t.TLSHandshakeTimeout = o.timeout
+	t.DialContext = o.dialer()
+	return t
+}
+
+// flagSet reports whether the named flag was passed, even if empty
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
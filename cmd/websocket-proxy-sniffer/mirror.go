@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+const (
+	// mirrorQueue is the number of client messages waiting to be sent to the
+	// mirror, once full new messages are dropped
+	mirrorQueue = 256
+	// mirrorPending is the number of responses kept for comparison while
+	// the other upstream catches up
+	mirrorPending = 64
+)
+
+// mirror sends the client messages of a session to a shadow upstream. Its
+// responses are logged and compared with the ones of the primary upstream
+// in order, but never reach the client. Failures of the mirror are logged
+// and don't affect the primary connection
+type mirror struct {
+	req      *http.Request
+	logFrame frameLogger
+	// redact, if set, applies to everything the mirror logs, the shadow
+	// upstream still gets the messages as they are
+	redact *redactor
+	frames chan *sniffer.Frame
+
+	lock    sync.Mutex
+	conn    io.ReadWriteCloser
+	closed  bool
+	primary []*sniffer.Frame
+	shadow  []*sniffer.Frame
+	// compared counts the responses already compared
+	compared int
+}
+
+// newMirror starts connecting to the mirror target in the background, using
+// the path of the client request as the reverse proxy does
+func newMirror(ctx context.Context, rt http.RoundTripper, target *url.URL,
+	r *http.Request, logFrame frameLogger, redact *redactor) *mirror {
+	// the logger tells the mirror frames apart by their remote address
+	req := r.WithContext(ctx)
+	req.RemoteAddr = r.RemoteAddr + " mirror"
+	m := &mirror{
+		req:      req,
+		logFrame: logFrame,
+		redact:   redact,
+		frames:   make(chan *sniffer.Frame, mirrorQueue),
+	}
+	u := *target
+	u.Path, u.RawQuery = r.URL.Path, r.URL.RawQuery
+	header := http.Header{}
+	for _, k := range []string{"Origin", "Sec-WebSocket-Protocol"} {
+		if v := r.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	go m.run(ctx, rt, &u, header)
+	return m
+}
+
+func (m *mirror) run(ctx context.Context, rt http.RoundTripper, u *url.URL,
+	header http.Header) {
+	conn, _, err := dialWebSocket(ctx, rt, u, header)
+	if err != nil {
+		log.Printf("%s: %v\n", connName(m.req), err)
+		m.close()
+		return
+	}
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		conn.Close()
+		return
+	}
+	m.conn = conn
+	m.lock.Unlock()
+
+	go m.readLoop(conn)
+	for f := range m.frames {
+		// the mirror gets its own mask key
+		if err := f.Mask(); err != nil {
+			log.Printf("%s: %v\n", connName(m.req), err)
+			break
+		}
+		if err := sniffer.WriteFrame(conn, f); err != nil {
+			log.Printf("%s: %v\n", connName(m.req), err)
+			break
+		}
+	}
+	m.close()
+}
+
+func (m *mirror) readLoop(conn io.Reader) {
+	mr := sniffer.NewMessageReader(sniffer.NewFrameReader(conn, false))
+	for {
+		f, err := mr.ReadMessage()
+		if err != nil {
+			m.lock.Lock()
+			closed := m.closed
+			m.lock.Unlock()
+			if err != io.EOF && !closed {
+				log.Printf("%s: %v\n", connName(m.req), err)
+			}
+			return
+		}
+		m.logFrame(m.req, sniffer.ServerToClient, m.redact.frame(f))
+		if !f.Opcode.IsControl() {
+			m.response(&m.shadow, f)
+		}
+	}
+}
+
+// send queues a decoded client message for the mirror, messages are sent
+// uncompressed since the mirror negotiates its own extensions
+func (m *mirror) send(f *sniffer.Frame) {
+	c := *f
+	c.Payload = append([]byte(nil), f.Payload...)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.frames <- &c:
+	default:
+		log.Printf("%s too slow, dropping %s message\n", connName(m.req), f.Opcode)
+	}
+}
+
+// primaryResponse records a data message from the primary upstream
+func (m *mirror) primaryResponse(f *sniffer.Frame) {
+	if !f.Opcode.IsControl() {
+		c := *f
+		c.Payload = append([]byte(nil), f.Payload...)
+		m.response(&m.primary, &c)
+	}
+}
+
+// response queues a response and compares the ones both upstreams have sent
+func (m *mirror) response(queue *[]*sniffer.Frame, f *sniffer.Frame) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(*queue) >= mirrorPending {
+		// the other upstream is too far behind to compare in order
+		*queue = (*queue)[1:]
+	}
+	*queue = append(*queue, f)
+	for len(m.primary) > 0 && len(m.shadow) > 0 {
+		p, s := m.primary[0], m.shadow[0]
+		m.primary, m.shadow = m.primary[1:], m.shadow[1:]
+		m.compared++
+		if !bytes.Equal(p.Payload, s.Payload) {
+			log.Printf("%s response %d differs, primary %q mirror %q\n",
+				connName(m.req), m.compared, m.redact.frame(p).Payload,
+				m.redact.frame(s).Payload)
+		}
+	}
+}
+
+// close tears down the mirror connection
+func (m *mirror) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.frames)
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
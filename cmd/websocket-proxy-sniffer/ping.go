@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// maxPings bounds the outstanding pings kept per connection even if the
+// peer floods pings within the window
+const maxPings = 64
+
+type pingKey struct {
+	dir     sniffer.Direction
+	payload string
+}
+
+// pingTracker matches the pongs of a connection with the pings they answer
+// to measure the round trip latency. Pings are forgotten after window
+type pingTracker struct {
+	lock   sync.Mutex
+	window time.Duration
+	pings  map[pingKey]time.Time
+}
+
+func newPingTracker(window time.Duration) *pingTracker {
+	return &pingTracker{
+		window: window,
+		pings:  make(map[pingKey]time.Time),
+	}
+}
+
+// ping records a ping sent in the given direction
+func (p *pingTracker) ping(dir sniffer.Direction, payload []byte, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k, t := range p.pings {
+		if now.Sub(t) > p.window {
+			delete(p.pings, k)
+		}
+	}
+	if len(p.pings) >= maxPings {
+		return
+	}
+	p.pings[pingKey{dir: dir, payload: string(payload)}] = now
+}
+
+// pong returns the latency of the ping answered by a pong sent in the given
+// direction, if any, and records it in the metrics
+func (p *pingTracker) pong(dir sniffer.Direction, payload []byte,
+	now time.Time) (time.Duration, bool) {
+	// the ping travelled the other way
+	pingDir := sniffer.ClientToServer
+	if dir == sniffer.ClientToServer {
+		pingDir = sniffer.ServerToClient
+	}
+	k := pingKey{dir: pingDir, payload: string(payload)}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.pings[k]
+	if !ok || now.Sub(t) > p.window {
+		return 0, false
+	}
+	delete(p.pings, k)
+	rtt := now.Sub(t)
+	metrics.AddPingRTT(pingDir, rtt)
+	return rtt, true
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// logSettings are the parsed settings of how frames are logged, shared by
+// every session whether it is proxied, connected to or decoded
+type logSettings struct {
+	frames   *frameLog
+	logFrame frameLogger
+	filter   *regexp.Regexp
+	opcodes  map[sniffer.Opcode]bool
+	sample   *sampler
+	redact   *redactor
+	// dirs are the directions logged and saved to -outdir
+	dirs [2]bool
+}
+
+// newLogSettings builds the frame log of cfg writing to stdout
+func newLogSettings(cfg *Config) (*logSettings, error) {
+	l := &logSettings{}
+	if cfg.Filter != "" {
+		re, err := regexp.Compile(cfg.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -filter: %w", err)
+		}
+		l.filter = re
+	}
+	var err error
+	if l.opcodes, err = parseOpcodes(cfg.Opcode); err != nil {
+		return nil, fmt.Errorf("invalid -opcode: %w", err)
+	}
+	seed := cfg.SampleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	l.sample = newSampler(cfg.Sample, seed)
+	if len(cfg.Redact) > 0 {
+		if l.redact, err = newRedactor(cfg.Redact); err != nil {
+			return nil, err
+		}
+	}
+	opts := sniffer.TextOptions{Pretty: cfg.Pretty, MaxBytes: cfg.MaxLogBytes}
+	if opts.Binary, err = sniffer.ParseBinaryFormat(cfg.Binary); err != nil {
+		return nil, err
+	}
+	useColor, err := colorMode(cfg.Color, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	var sink sniffer.Sink
+	if cfg.Format == "text" {
+		// colors only make sense for the text format
+		opts.Color = useColor
+		sink = sniffer.NewTextSink(os.Stdout, opts)
+	} else if opts != (sniffer.TextOptions{}) {
+		return nil, errors.New("-pretty, -binary and -max-log-bytes need -format text")
+	} else if sink, err = sniffer.NewSink(cfg.Format, os.Stdout); err != nil {
+		return nil, err
+	}
+	if cfg.Publish != "" {
+		network, addr, err := parsePublish(cfg.Publish)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -publish: %w", err)
+		}
+		sink = sniffer.MultiSink{sink, sniffer.NewDatagramSink(network, addr, publishMaxSize)}
+	}
+	if l.dirs, err = parseDirection(cfg.Direction); err != nil {
+		return nil, err
+	}
+	if !l.dirs[sniffer.ServerToClient] {
+		sink = sniffer.DirectionSink{Sink: sink, Direction: sniffer.ClientToServer}
+	} else if !l.dirs[sniffer.ClientToServer] {
+		sink = sniffer.DirectionSink{Sink: sink, Direction: sniffer.ServerToClient}
+	}
+	l.frames = newFrameLog(sink, cfg.UTC)
+	l.frames.headers = cfg.HeadersOnly
+	l.logFrame = l.frames.frameLogger(cfg.Verbosity)
+	return l, nil
+}
+
+// newSession returns a session logging the frames of r
+func (l *logSettings) newSession(cfg *Config, r *http.Request) *session {
+	return &session{
+		req:      r,
+		logFrame: l.logFrame,
+		pings:    newPingTracker(cfg.PingWindow),
+		bufSize:  cfg.BufSize,
+		maxFrame: cfg.MaxFrame,
+		filter:   l.filter,
+		opcodes:  l.opcodes,
+		sample:   l.sample,
+		redact:   l.redact,
+
+		headersOnly: cfg.HeadersOnly,
+		maxMessage:  cfg.MaxMessage,
+
+		verbosity: cfg.Verbosity,
+	}
+}
+
+// Proxy sniffs the websockets it proxies to the upstreams of a Config. It
+// must be served with ConnContext set as the http.Server ConnContext
+type Proxy struct {
+	handler http.Handler
+	tracker *connTracker
+	// admin, if set, must be served on -admin-listen
+	admin *adminServer
+	stats *countStats
+	har   *harRecorder
+	sum   *summary
+	// pcap, if set, is the -pcap file
+	pcap    io.Closer
+	harFile string
+}
+
+// NewProxy validates cfg and sets up the proxy it describes, with its
+// sinks, captures and upstreams. Nothing is listened on
+func NewProxy(cfg Config) (*Proxy, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	ls, err := newLogSettings(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	frames, logFrame, redact := ls.frames, ls.logFrame, ls.redact
+	var rewrites []headerRewrite
+	for _, s := range cfg.SetHeaders {
+		hr, err := parseHeaderRewrite(s)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, hr)
+	}
+	if cfg.Origin != nil {
+		rewrites = append(rewrites, originRewrite(*cfg.Origin)...)
+	}
+	rts, err := cfg.routes()
+	if err != nil {
+		return nil, err
+	}
+	dialOpts := cfg.dialOptions()
+	transport := newTransport(dialOpts)
+	targets := make([]*url.URL, 0, len(rts))
+	for _, rt := range rts {
+		targets = append(targets, rt.target)
+	}
+	var mirrorTarget *url.URL
+	if cfg.Mirror != "" {
+		if mirrorTarget, err = parseTarget(cfg.Mirror); err != nil {
+			return nil, err
+		}
+	}
+	p := &Proxy{
+		tracker: newConnTracker(cfg.MaxConns),
+		harFile: cfg.Har,
+	}
+	var pw *sniffer.PcapWriter
+	if cfg.Pcap != "" {
+		f, err := os.Create(cfg.Pcap)
+		if err != nil {
+			return nil, err
+		}
+		fw := sniffer.NewFlushWriter(f, cfg.FlushInterval)
+		if pw, err = sniffer.NewPcapWriter(fw); err != nil {
+			fw.Close()
+			return nil, err
+		}
+		p.pcap = fw
+	}
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		ModifyResponse: func(res *http.Response) error {
+			logRejectedUpgrade(res)
+			return sniffer.RecordHandshake(res)
+		},
+		Director: func(r *http.Request) {
+			u := routeTarget(r)
+			r.URL.Scheme = u.Scheme
+			r.URL.Host = u.Host
+			r.Host = u.Host
+			for _, hr := range rewrites {
+				hr.apply(r.Header)
+			}
+		},
+	}
+	if cfg.Har != "" {
+		p.har = newHarRecorder(redact)
+	}
+	if cfg.Summary {
+		p.sum = newSummary()
+	}
+	har, sum, tracker := p.har, p.sum, p.tracker
+	// with a nil onFrame connections are tee'd with sniffer.TeeConn, which
+	// copies the bytes as they come without parsing them. -readonly relies on
+	// that, parsed frames are encoded again before reaching the peer
+	var onFrame sniffer.OnFrame
+	if !cfg.Readonly && (cfg.AdminListen != "" || cfg.Exec != "" || cfg.HeaderTimeout > 0) {
+		// frames can only be injected into, changed on or timed on
+		// connections being parsed, -exec sets its own onFrame for each of
+		// them
+		onFrame = func(dir sniffer.Direction, f *sniffer.Frame) *sniffer.Frame {
+			return f
+		}
+	}
+	if cfg.AdminListen != "" {
+		p.admin = newAdminServer()
+		p.admin.readonly = cfg.Readonly
+		// transparent proxies and echo servers have no upstream of their own
+		if cfg.ReadyProbe && cfg.Mode == "reverse" && !cfg.Echo {
+			p.admin.ready = func(ctx context.Context) error {
+				for _, u := range targets {
+					if _, err := probe(ctx, transport, u); err != nil {
+						return fmt.Errorf("%s: %w", u, err)
+					}
+				}
+				return nil
+			}
+		}
+	}
+	admin := p.admin
+	execArgs := strings.Fields(cfg.Exec)
+	execs := newExecLimiter(cfg.ExecMax)
+	if cfg.CountOnly {
+		p.stats = newCountStats()
+	}
+	stats := p.stats
+	var backend http.Handler = proxy
+	if cfg.Echo {
+		backend = echoServer{}
+	}
+	if cfg.TrustXFF {
+		backend = restorePeer(backend)
+	}
+	handler := sniffer.FrameSniffer(backend, func(ctx context.Context, r *http.Request,
+		in, out io.Reader) {
+		done := tracker.add(r)
+		if stats != nil {
+			// the readers get no data, they only tell when the connection
+			// is done
+			go func() {
+				io.Copy(ioutil.Discard, in)
+				done()
+			}()
+			return
+		}
+		hs := sniffer.GetHandshake(r)
+		upstream := "unknown"
+		switch {
+		case cfg.Echo:
+			upstream = "echo"
+		case hs.Upstream != nil:
+			upstream = hs.Upstream.Host
+		}
+		cookies, setCookies := handshakeCookies(r, hs, redact)
+		frames.logConn(sniffer.ConnEvent{
+			Event:          sniffer.ConnOpen,
+			ConnID:         sniffer.ConnID(r),
+			RemoteAddr:     r.RemoteAddr,
+			URL:            r.URL.String(),
+			Upstream:       upstream,
+			RequestHeader:  redact.headers(r.Header),
+			ResponseHeader: redact.headers(hs.Header),
+			Cookies:        cookies,
+			SetCookies:     setCookies,
+		})
+		checkAccept(r, hs, sum)
+		if cfg.Handshake {
+			var b strings.Builder
+			dumpHandshake(&b, r, hs, redact)
+			log.Printf("%s handshake\n%s", connName(r), b.String())
+		}
+		var hook *execHook
+		if len(execArgs) > 0 {
+			if hook = execs.start(execArgs, r); hook != nil {
+				sniffer.SetOnFrame(r, hook.onFrame)
+			}
+		}
+		var closers []io.Closer
+		var ndjson *sniffer.CaptureWriter
+		if cfg.Outdir != "" {
+			// routed upstreams get a directory each
+			dir := cfg.Outdir
+			var err error
+			if len(cfg.Routes) > 0 {
+				dir, err = targetDir(dir, upstream)
+			}
+			var c *capture
+			if err == nil {
+				// raw bytes can't be redacted, only the messages
+				c, err = newCapture(dir, r, cfg.FlushInterval, cfg.Compress,
+					redact == nil, cfg.NDJSON)
+			}
+			if err != nil {
+				log.Println(err)
+			} else {
+				if cfg.Handshake {
+					if err := c.writeHandshake(r, hs, redact); err != nil {
+						log.Println(err)
+					}
+				}
+				if c.ndjson != nil {
+					hr := r.WithContext(r.Context())
+					hr.Header = redact.headers(r.Header)
+					err := c.ndjson.WriteHandshake(hr, redact.headers(hs.Header), time.Now())
+					if err != nil {
+						log.Println(err)
+					} else {
+						ndjson = c.ndjson
+					}
+				}
+				// the other direction is still read, its file stays empty
+				if c.in != nil && ls.dirs[sniffer.ClientToServer] {
+					in = io.TeeReader(in, c.in)
+				}
+				if c.out != nil && ls.dirs[sniffer.ServerToClient] {
+					out = io.TeeReader(out, c.out)
+				}
+				closers = append(closers, c)
+			}
+		}
+		if pw != nil {
+			c, err := newPcapConn(pw, r)
+			if err != nil {
+				log.Println(err)
+			} else {
+				in = io.TeeReader(in, c.In())
+				out = io.TeeReader(out, c.Out())
+				closers = append(closers, c)
+			}
+		}
+		s := ls.newSession(&cfg, r)
+		s.alertFPS, s.alertWindow = cfg.AlertFPS, cfg.AlertWindow
+		s.opened = time.Now()
+		s.summary = sum
+		for dir, on := range ls.dirs {
+			if on {
+				s.ndjson[dir] = ndjson
+			}
+		}
+		unregister := func() {}
+		if admin != nil {
+			unregister = admin.add(s, upstream)
+		}
+		if mirrorTarget != nil {
+			s.mirror = newMirror(ctx, transport, mirrorTarget, r, logFrame, redact)
+		}
+		if har != nil {
+			s.har = har.add(r)
+		}
+		if cfg.History > 0 {
+			s.history = newHistory(cfg.History)
+		}
+		var wg sync.WaitGroup
+		var errs [2]error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs[0] = s.readLoop(ctx, in, sniffer.ClientToServer)
+		}()
+		go func() {
+			defer wg.Done()
+			errs[1] = s.readLoop(ctx, out, sniffer.ServerToClient)
+		}()
+		go func() {
+			wg.Wait()
+			for _, c := range closers {
+				if err := c.Close(); err != nil {
+					log.Println(err)
+				}
+			}
+			s.har.close()
+			if hook != nil {
+				hook.close()
+			}
+			if s.mirror != nil {
+				s.mirror.close()
+			}
+			err := errs[0]
+			if err == nil {
+				err = errs[1]
+			}
+			ev := s.closeEvent(err)
+			frames.logConn(ev)
+			if reason := abnormalClose(ev); reason != "" {
+				s.history.dump(r, reason)
+			}
+			sum.addConn(ev)
+			unregister()
+			done()
+		}()
+	}, onFrame)
+	if stats != nil {
+		handler = sniffer.CountOnly(handler, &stats.counts)
+	}
+	if cfg.IdleTimeout > 0 {
+		handler = sniffer.IdleTimeout(handler, cfg.IdleTimeout)
+	}
+	if cfg.HeaderTimeout > 0 {
+		handler = sniffer.HeaderTimeout(handler, cfg.HeaderTimeout)
+	}
+	if cfg.Strict {
+		handler = sniffer.Strict(handler)
+	}
+	if cfg.HTTP2 {
+		handler = sniffer.HTTP2(handler)
+	}
+	if len(cfg.AllowCIDR) > 0 || len(cfg.DenyCIDR) > 0 {
+		// after trustForwarded, so it is the client behind a proxy that
+		// is filtered
+		handler, err = newClientFilter(handler, backend, cfg.AllowCIDR,
+			cfg.DenyCIDR, cfg.DenyAction == "reject")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TrustXFF {
+		handler = trustForwarded(handler)
+	}
+	var routed http.Handler = newRouter(rts, handler)
+	if cfg.Mode == "transparent" {
+		routed = newTransparentProxy(handler, tracker.ConnContext, dialOpts.dialer())
+	}
+	if cfg.CORSOrigin != "" {
+		routed = newCORS(routed, cfg.CORSOrigin, cfg.CORSHeaders)
+	}
+	p.handler = tracker.Limit(routed)
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// ConnContext must be set as the http.Server ConnContext, so hijacked
+// connections can be tracked and tunnels served
+func (p *Proxy) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return p.tracker.ConnContext(ctx, c)
+}
+
+// logStats logs the -count-only counts every interval, it never returns
+func (p *Proxy) logStats(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		log.Println(p.stats.report(now))
+	}
+}
+
+// Shutdown waits for the hijacked connections to be done, or closes them once
+// the context is done, and then writes the reports, -har, the -count-only
+// counts and the -summary. The servers must have been shut down already
+func (p *Proxy) Shutdown(ctx context.Context) {
+	if err := p.tracker.wait(ctx); err != nil {
+		log.Println("closing active connections")
+		p.tracker.closeAll()
+		// wait for the read loops to finish so captures are closed
+		p.tracker.wait(context.Background())
+	}
+	if p.pcap != nil {
+		if err := p.pcap.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if p.har != nil {
+		if err := writeHar(p.harFile, p.har); err != nil {
+			log.Println(err)
+		}
+	}
+	if p.stats != nil {
+		log.Println(p.stats.report(time.Now()))
+	}
+	if p.sum != nil {
+		// stdout may be json lines
+		p.sum.WriteTo(os.Stderr)
+	}
+}
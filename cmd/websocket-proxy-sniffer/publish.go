@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// publishMaxSize is the largest datagram sent by -publish, it fits in the
+// loopback MTU and the default socket buffers
+const publishMaxSize = 8192
+
+// parsePublish returns the network and address of a -publish url, either
+// udp://host:port or unixgram:///path
+func parsePublish(s string) (network, addr string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("%q has no host:port", s)
+		}
+		return "udp", u.Host, nil
+	case "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("%q has no socket path", s)
+		}
+		return "unixgram", u.Path, nil
+	}
+	return "", "", fmt.Errorf("unknown scheme %q, must be udp or unixgram", u.Scheme)
+}
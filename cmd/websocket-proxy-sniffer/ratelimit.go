@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket of bytes per second. Callers that exceed the
+// rate go into debt and sleep it off outside the lock, so a blocked peer
+// never stalls other users of the same limiter
+type limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter allows rate bytes per second with bursts of up to one second
+func newLimiter(rate int) *limiter {
+	return &limiter{
+		rate:   float64(rate),
+		burst:  rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes are allowed, n shouldn't exceed the burst. It
+// returns false if done is closed first
+func (l *limiter) wait(n int, done <-chan struct{}) bool {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay == 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// limitedListener throttles the connections it accepts, limiters are either
+// shared by all connections or created for each one
+type limitedListener struct {
+	net.Listener
+	inRate  int
+	outRate int
+	global  bool
+	in      *limiter
+	out     *limiter
+}
+
+// newLimitedListener throttles reads to inRate and writes to outRate bytes
+// per second, zero means no limit
+func newLimitedListener(ln net.Listener, inRate, outRate int,
+	global bool) net.Listener {
+	if inRate <= 0 && outRate <= 0 {
+		return ln
+	}
+	l := &limitedListener{
+		Listener: ln,
+		inRate:   inRate,
+		outRate:  outRate,
+		global:   global,
+	}
+	if global {
+		l.in, l.out = l.newLimiters()
+	}
+	return l
+}
+
+// share returns a listener that throttles the connections of ln as l does,
+// global limiters are shared by both
+func (l *limitedListener) share(ln net.Listener) net.Listener {
+	c := *l
+	c.Listener = ln
+	return &c
+}
+
+func (l *limitedListener) newLimiters() (in, out *limiter) {
+	if l.inRate > 0 {
+		in = newLimiter(l.inRate)
+	}
+	if l.outRate > 0 {
+		out = newLimiter(l.outRate)
+	}
+	return in, out
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	in, out := l.in, l.out
+	if !l.global {
+		in, out = l.newLimiters()
+	}
+	return &limitedConn{
+		Conn:   conn,
+		in:     in,
+		out:    out,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+type limitedConn struct {
+	net.Conn
+	in        *limiter
+	out       *limiter
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.in == nil {
+		return c.Conn.Read(p)
+	}
+	if len(p) > c.in.burst {
+		p = p[:c.in.burst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.in.wait(n, c.closed)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if c.out == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.out.burst {
+			chunk = chunk[:c.out.burst]
+		}
+		if !c.out.wait(len(chunk), c.closed) {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
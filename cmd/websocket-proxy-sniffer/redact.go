@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// redactMask replaces the redacted data
+const redactMask = "***"
+
+// redactor removes sensitive data from text payloads. Rules starting with $
+// are json paths, either $.a.b for a field from the root or $..name for a
+// field at any depth, anything else is a regular expression
+type redactor struct {
+	regexps []*regexp.Regexp
+	paths   []jsonPath
+}
+
+type jsonPath struct {
+	keys []string
+	// anywhere matches the last key at any depth
+	anywhere bool
+}
+
+func newRedactor(rules []string) (*redactor, error) {
+	r := &redactor{}
+	for _, rule := range rules {
+		switch {
+		case strings.HasPrefix(rule, "$.."):
+			r.paths = append(r.paths, jsonPath{
+				keys:     []string{rule[3:]},
+				anywhere: true,
+			})
+		case strings.HasPrefix(rule, "$."):
+			r.paths = append(r.paths, jsonPath{keys: strings.Split(rule[2:], ".")})
+		default:
+			re, err := regexp.Compile(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redact rule %q: %w", rule, err)
+			}
+			r.regexps = append(r.regexps, re)
+		}
+	}
+	return r, nil
+}
+
+// redact returns the payload with every match replaced by the mask
+func (r *redactor) redact(payload []byte) []byte {
+	if len(r.paths) > 0 {
+		payload = redactJSON(payload, r.paths)
+	}
+	for _, re := range r.regexps {
+		payload = re.ReplaceAll(payload, []byte(redactMask))
+	}
+	return payload
+}
+
+func (p jsonPath) match(keys []string) bool {
+	if p.anywhere {
+		return len(keys) > 0 && keys[len(keys)-1] == p.keys[0]
+	}
+	if len(keys) != len(p.keys) {
+		return false
+	}
+	for i := range keys {
+		if keys[i] != p.keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// redactJSON replaces the values at the given paths with the mask, leaving
+// the rest of the document byte for byte untouched. Array elements don't add
+// to the path. Payloads that aren't json are returned as they are
+func redactJSON(data []byte, paths []jsonPath) []byte {
+	type container struct {
+		object  bool
+		key     string
+		wantKey bool
+	}
+	var stack []*container
+	keys := func() []string {
+		var keys []string
+		for _, c := range stack {
+			if c.object {
+				keys = append(keys, c.key)
+			}
+		}
+		return keys
+	}
+	matches := func() bool {
+		if len(stack) == 0 || !stack[len(stack)-1].object {
+			return false
+		}
+		k := keys()
+		for _, p := range paths {
+			if p.match(k) {
+				return true
+			}
+		}
+		return false
+	}
+	// a value is done, the object holding it expects a key next
+	valueDone := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].wantKey = true
+		}
+	}
+
+	var ranges [][2]int64
+	redactFrom, redactDepth := int64(-1), 0
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for {
+		before := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return data
+		}
+		after := dec.InputOffset()
+		// the token starts after any separator
+		start := before
+		for start < after && strings.IndexByte(" \t\r\n:,", data[start]) >= 0 {
+			start++
+		}
+
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if redactFrom >= 0 && len(stack) == redactDepth {
+				ranges = append(ranges, [2]int64{redactFrom, after})
+				redactFrom = -1
+			}
+			valueDone()
+			continue
+		}
+		if n := len(stack); n > 0 && stack[n-1].wantKey {
+			stack[n-1].key, _ = tok.(string)
+			stack[n-1].wantKey = false
+			continue
+		}
+		if redactFrom < 0 && matches() {
+			if isDelim {
+				redactFrom, redactDepth = start, len(stack)
+			} else {
+				ranges = append(ranges, [2]int64{start, after})
+			}
+		}
+		if isDelim {
+			stack = append(stack, &container{object: delim == '{', wantKey: delim == '{'})
+			continue
+		}
+		valueDone()
+	}
+	if len(ranges) == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	last := int64(0)
+	for _, r := range ranges {
+		out = append(out, data[last:r[0]]...)
+		out = append(out, '"')
+		out = append(out, redactMask...)
+		out = append(out, '"')
+		last = r[1]
+	}
+	return append(out, data[last:]...)
+}
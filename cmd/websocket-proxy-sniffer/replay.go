@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// replayCloseWait is how long to wait for the server to close the connection
+// after all frames have been sent
+const replayCloseWait = 5 * time.Second
+
+// replayFrame returns the next client frame of a capture, masked, and when it
+// was captured, zero if the capture has no timing. It returns io.EOF at the
+// end of the capture
+type replayFrame func() (*sniffer.Frame, time.Time, error)
+
+// isNDJSON reports whether the capture file name is a .ndjson capture, which
+// has the timing of its frames, gzipped or not
+func isNDJSON(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, ".gz"), ".ndjson")
+}
+
+// replayFrames returns the client frames of a .ndjson capture or of a raw .in
+// capture, either gzipped if name ends in .gz
+func replayFrames(r io.Reader, name string) (replayFrame, error) {
+	if !isNDJSON(name) {
+		fr := sniffer.NewFrameReader(r, true)
+		return func() (*sniffer.Frame, time.Time, error) {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			// frames are masked again with their original key
+			frame.Masked = true
+			return frame, time.Time{}, nil
+		}, nil
+	}
+	cr, err := sniffer.NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*sniffer.Frame, time.Time, error) {
+		for {
+			rec, frame, dir, err := cr.ReadFrame()
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			if dir != sniffer.ClientToServer {
+				continue
+			}
+			// the capture has the payloads unmasked
+			if err := frame.Mask(); err != nil {
+				return nil, time.Time{}, err
+			}
+			return frame, rec.Time, nil
+		}
+	}, nil
+}
+
+// replay sends the client frames of a capture file to the target and logs
+// every frame sent and received. Raw .in captures don't record timing, so
+// their frames are sent as fast as the server accepts them, the frames of
+// .ndjson captures can be sent with their original timing with realtime. The
+// frames are logged once redacted by redact, if set
+func replay(ctx context.Context, rt http.RoundTripper, u *url.URL, file string,
+	realtime bool, logFrame frameLogger, redact *redactor) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	// as saved by -outdir with -compress
+	if strings.HasSuffix(file, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	next, err := replayFrames(r, file)
+	if err != nil {
+		return err
+	}
+
+	conn, resp, err := dialWebSocket(ctx, rt, u, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the logger expects a request, use the target as the remote address
+	req := resp.Request
+	req.RemoteAddr = u.Host
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mr := sniffer.NewMessageReader(sniffer.NewFrameReader(conn, false))
+		for {
+			m, err := mr.ReadMessage()
+			if err != nil {
+				if err != io.EOF {
+					log.Println(err)
+				}
+				return
+			}
+			logFrame(req, sniffer.ServerToClient, redact.frame(m))
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for {
+		frame, ts, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case !realtime:
+		case first.IsZero():
+			first = ts
+		default:
+			select {
+			case <-time.After(time.Until(start.Add(ts.Sub(first)))):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err := sniffer.WriteFrame(conn, frame); err != nil {
+			return err
+		}
+		logFrame(req, sniffer.ClientToServer, redact.frame(frame))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(replayCloseWait):
+	case <-ctx.Done():
+	}
+	return nil
+}
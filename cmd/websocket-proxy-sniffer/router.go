@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// stringsFlag collects the values of a repeated flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// route sends the requests matching a host or a path prefix to a target, a
+// route without host nor prefix matches everything
+type route struct {
+	host   string
+	prefix string
+	target *url.URL
+}
+
+// parseRoute parses host=url or /prefix=url
+func parseRoute(s string) (route, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return route{}, fmt.Errorf("invalid route %q: expected match=url", s)
+	}
+	u, err := parseTarget(s[i+1:])
+	if err != nil {
+		return route{}, err
+	}
+	rt := route{target: u}
+	if match := s[:i]; strings.HasPrefix(match, "/") {
+		rt.prefix = match
+	} else {
+		rt.host = strings.ToLower(match)
+	}
+	return rt, nil
+}
+
+// parseTarget parses the upstream url and maps websocket schemes to their http
+// equivalents, which is what the reverse proxy knows how to dial
+func parseTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("invalid target %q: unsupported scheme %q",
+			target, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid target %q: missing host", target)
+	}
+	return u, nil
+}
+
+type targetKey struct{}
+
+// routeTarget returns the target selected by the router for the request
+func routeTarget(r *http.Request) *url.URL {
+	u, _ := r.Context().Value(targetKey{}).(*url.URL)
+	return u
+}
+
+// router picks the target of each request and stores it in the request
+// context before calling the next handler, requests without a matching route
+// get a 502 and CONNECT tunnels a 405
+type router struct {
+	routes []route
+	next   http.Handler
+}
+
+func newRouter(routes []route, next http.Handler) *router {
+	return &router{routes: routes, next: next}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// tunnels are only opened by transparent proxies, websockets over HTTP/2
+	// use CONNECT too but they are routed as any other handshake
+	if r.Method == http.MethodConnect && !sniffer.IsExtendedConnect(r) {
+		http.Error(w, "CONNECT is only supported with -mode transparent",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	u := rt.match(r)
+	if u == nil {
+		http.Error(w, fmt.Sprintf("no route for host %q and path %q",
+			r.Host, r.URL.Path), http.StatusBadGateway)
+		return
+	}
+	ctx := context.WithValue(r.Context(), targetKey{}, u)
+	rt.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// match returns the target of the first route matching the host, or else the
+// one with the longest matching path prefix
+func (rt *router) match(r *http.Request) *url.URL {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	var best *route
+	for i := range rt.routes {
+		route := &rt.routes[i]
+		switch {
+		case route.host != "":
+			if route.host == host {
+				return route.target
+			}
+		case strings.HasPrefix(r.URL.Path, route.prefix):
+			if best == nil || len(route.prefix) > len(best.prefix) {
+				best = route
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.target
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// sampler decides which data frames get logged on -sample, it is shared by
+// all connections. The seed makes the choices reproducible
+type sampler struct {
+	lock sync.Mutex
+	rate float64
+	rnd  *rand.Rand
+}
+
+// newSampler returns a sampler that keeps rate of the frames, or nil if it
+// keeps all of them
+func newSampler(rate float64, seed int64) *sampler {
+	if rate >= 1 {
+		return nil
+	}
+	return &sampler{rate: rate, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// keep reports whether the next frame must be logged, a nil sampler keeps
+// them all
+func (s *sampler) keep() bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rnd.Float64() < s.rate
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// session holds the state of a hijacked connection shared by the read loops
+// of both directions, which run in their own goroutines. The settings are
+// read only once the loops start, the trackers and recorders they share do
+// their own locking, and the stats are guarded by lock as the admin endpoint
+// reads them while the connection is live. Anything else a loop needs, like
+// its frame reader or inflater, is owned by it
+type session struct {
+	req      *http.Request
+	logFrame frameLogger
+	pings    *pingTracker
+	bufSize  int
+	maxFrame uint64
+	// maxMessage is the largest reassembled message, zero means no limit
+	maxMessage uint64
+	// filter, if set, must match the payload for a frame to be logged
+	filter *regexp.Regexp
+	// opcodes, if set, are the message types that are logged
+	opcodes map[sniffer.Opcode]bool
+	// headersOnly logs every frame as it is read, its header only, instead
+	// of the messages
+	headersOnly bool
+	// sample, if set, picks the data frames that are logged
+	sample *sampler
+	redact *redactor
+	har    *harEntry
+	// history, if set, keeps the last server messages
+	history *history
+	// verbosity is the -v level
+	verbosity int
+	// mirror, if set, gets a copy of the client messages
+	mirror *mirror
+	// summary, if set, aggregates the frames of every session
+	summary *summary
+	// ndjson, if set for a direction, records its frames as they are read,
+	// or its messages once redacted with redact
+	ndjson [2]*sniffer.CaptureWriter
+	// alertFPS, if positive, is the frame rate over alertWindow above which
+	// a warning is logged
+	alertFPS    float64
+	alertWindow time.Duration
+
+	// opened is when the connection was hijacked
+	opened time.Time
+
+	lock  sync.Mutex
+	stats [2]dirStats
+	// closeCode is the status of the first close frame seen
+	closeCode uint16
+}
+
+type dirStats struct {
+	Bytes  uint64 `json:"bytes"`
+	Frames uint64 `json:"frames"`
+	// Last is when the last byte was seen, zero if none was
+	Last time.Time `json:"last_activity"`
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	r   io.Reader
+	s   *session
+	dir sniffer.Direction
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.s.lock.Lock()
+		c.s.stats[c.dir].Bytes += uint64(n)
+		c.s.stats[c.dir].Last = time.Now()
+		c.s.lock.Unlock()
+	}
+	return n, err
+}
+
+// capture records f to the ndjson capture of dir, if any. A capture that
+// fails isn't written to again
+func (s *session) capture(dir sniffer.Direction, f *sniffer.Frame) {
+	c := s.ndjson[dir]
+	if c == nil {
+		return
+	}
+	if err := c.WriteFrame(dir, f, time.Now()); err != nil {
+		log.Println(err)
+		s.ndjson[dir] = nil
+	}
+}
+
+// readLoop logs the frames read from r until it fails or the context is
+// done. It returns the error that stopped it, or nil if the connection was
+// closed cleanly
+func (s *session) readLoop(ctx context.Context, r io.Reader, dir sniffer.Direction) error {
+	r = &countReader{r: r, s: s, dir: dir}
+	// only client frames are masked
+	fr := sniffer.NewFrameReaderSize(r, dir == sniffer.ClientToServer, s.bufSize)
+	fr.MaxSize = s.maxFrame
+	mr := sniffer.NewMessageReader(fr)
+	mr.MaxSize = s.maxMessage
+	alert := newRateAlert(s.alertFPS, s.alertWindow)
+	mr.OnFrame = func(f *sniffer.Frame) {
+		metrics.AddFrame(dir, f)
+		if s.redact == nil {
+			s.capture(dir, f)
+		}
+		s.summary.addFrame(f)
+		if rate, ok := alert.add(time.Now()); ok {
+			log.Printf("WARNING: %s %s is sending %.1f frames per second over "+
+				"the last %s, above -alert-fps\n", dir, connName(s.req), rate, s.alertWindow)
+		}
+		s.lock.Lock()
+		s.stats[dir].Frames++
+		if f.Opcode == sniffer.OpClose && s.closeCode == 0 {
+			s.closeCode, _ = f.CloseStatus()
+		}
+		s.lock.Unlock()
+		// RFC 6455 section 5.1, servers must not mask their frames
+		if dir == sniffer.ServerToClient && f.Masked {
+			log.Printf("WARNING: %s %s %s frame masked by the server, "+
+				"violates RFC 6455\n", dir, connName(s.req), f.Opcode)
+			metrics.AddViolation("masked_server_frame")
+			s.summary.addViolation()
+		}
+		if s.headersOnly {
+			s.logFrame(s.req, dir, f)
+		}
+	}
+	var inflate *sniffer.Inflater
+	warnedRsv := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		f, err := mr.ReadMessage()
+		if err != nil {
+			if errors.Is(err, sniffer.ErrFrameTooLarge) ||
+				errors.Is(err, sniffer.ErrMessageTooLarge) {
+				s.close()
+			}
+			// keep draining so the proxied connection doesn't get stuck
+			io.Copy(ioutil.Discard, r)
+			switch {
+			case errors.Is(err, sniffer.ErrIdleTimeout):
+				// both directions see it, log it once
+				if dir == sniffer.ClientToServer {
+					log.Printf("%s closed, idle for too long\n", connName(s.req))
+				}
+				return nil
+			case errors.Is(err, sniffer.ErrHeaderTimeout):
+				if dir == sniffer.ClientToServer {
+					log.Printf("%s closed, frame header too slow\n", connName(s.req))
+				}
+				return err
+			case errors.Is(err, sniffer.ErrMessageTooLarge):
+				log.Printf("WARNING: %s %s closed, fragmented message above "+
+					"-max-message: %v\n", dir, connName(s.req), err)
+				return err
+			case isClosed(err):
+				return nil
+			}
+			log.Printf("%s %s read error: %v\n", dir, connName(s.req), err)
+			return err
+		}
+		if f.Compressed() {
+			// the handshake is done by the time the first frame arrives
+			if inflate == nil {
+				inflate = sniffer.NewInflater(sniffer.ResponseHeader(s.req), dir)
+			}
+			if inflate != nil {
+				if err := inflate.Inflate(f); err != nil {
+					log.Printf("%s %s inflate: %v\n", dir, connName(s.req), err)
+				}
+			}
+		}
+		if f.Rsv != 0 && inflate == nil && !warnedRsv {
+			log.Printf("WARNING: %s %s frames use RSV bits of an extension that "+
+				"wasn't negotiated, logging them as opaque\n", dir, connName(s.req))
+			warnedRsv = true
+		}
+		// the mirror must get the messages before they are redacted
+		if s.mirror != nil {
+			if dir == sniffer.ClientToServer {
+				s.mirror.send(f)
+			} else {
+				s.mirror.primaryResponse(f)
+			}
+		}
+		// RFC 6455 section 8.1, text messages must be valid UTF-8. The
+		// invalid bytes are replaced so the log stays readable
+		if f.Opcode == sniffer.OpText && f.Rsv == 0 && !utf8.Valid(f.Payload) {
+			log.Printf("WARNING: %s %s TEXT message isn't valid UTF-8, "+
+				"violates RFC 6455\n", dir, connName(s.req))
+			metrics.AddViolation("invalid_utf8")
+			s.summary.addViolation()
+			f.Payload = bytes.ToValidUTF8(f.Payload, []byte("\uFFFD"))
+		}
+		// record pings as soon as possible so a quick pong can't race them,
+		// and match pongs before they may be filtered out
+		var rtt time.Duration
+		var rttOK bool
+		switch f.Opcode {
+		case sniffer.OpPing:
+			s.pings.ping(dir, f.Payload, time.Now())
+		case sniffer.OpPong:
+			rtt, rttOK = s.pings.pong(dir, f.Payload, time.Now())
+		}
+		// nothing may see the payload before it is redacted
+		if s.redact != nil && f.Opcode == sniffer.OpText {
+			f.Payload = s.redact.redact(f.Payload)
+		}
+		// raw frames may be compressed or split a match across fragments,
+		// whole messages can be redacted
+		if s.redact != nil {
+			s.capture(dir, f)
+		}
+		s.har.add(dir, f)
+		if dir == sniffer.ServerToClient {
+			s.history.add(f)
+		}
+		if s.headersOnly {
+			continue
+		}
+		if s.filter != nil && !s.filter.Match(f.Payload) {
+			metrics.AddFiltered()
+			continue
+		}
+		if s.opcodes != nil && !s.opcodes[f.Opcode] {
+			metrics.AddFiltered()
+			continue
+		}
+		// control frames are rare and tell how the connection is doing
+		if !f.Opcode.IsControl() && !s.sample.keep() {
+			continue
+		}
+		s.logFrame(s.req, dir, f)
+		if rttOK && s.verbosity >= verbositySummary {
+			log.Printf("%s %s PONG latency %s\n", dir, connName(s.req), rtt)
+		}
+	}
+}
+
+// isClosed reports whether err is how the readers report a connection closed
+// by either peer or by the proxy
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled)
+}
+
+// closeEvent summarizes the session, it must be called once both read loops
+// are done. err is the first error they returned
+func (s *session) closeEvent(err error) sniffer.ConnEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ev := sniffer.ConnEvent{
+		Event:        sniffer.ConnClose,
+		ConnID:       sniffer.ConnID(s.req),
+		RemoteAddr:   s.req.RemoteAddr,
+		URL:          s.req.URL.String(),
+		ClientBytes:  s.stats[sniffer.ClientToServer].Bytes,
+		ClientFrames: s.stats[sniffer.ClientToServer].Frames,
+		ServerBytes:  s.stats[sniffer.ServerToClient].Bytes,
+		ServerFrames: s.stats[sniffer.ServerToClient].Frames,
+		CloseCode:    s.closeCode,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// snapshot returns the stats of both directions so far
+func (s *session) snapshot() [2]dirStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// close closes the underlying connection of the session, which makes the
+// reverse proxy tear down both directions
+func (s *session) close() {
+	if conn, ok := s.req.Context().Value(connContextKey{}).(net.Conn); ok {
+		conn.Close()
+	}
+}
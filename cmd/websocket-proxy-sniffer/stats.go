@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// countStats reports the traffic counted on -count-only
+type countStats struct {
+	counts [2]sniffer.FrameCounts
+
+	lock sync.Mutex
+	// last are the counts of the previous report, to tell the rates
+	last     [2]sniffer.FrameCounts
+	lastTime time.Time
+}
+
+func newCountStats() *countStats {
+	return &countStats{lastTime: time.Now()}
+}
+
+// report returns the totals of both directions and their rates since the
+// previous report
+func (s *countStats) report(now time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elapsed := now.Sub(s.lastTime).Seconds()
+	parts := make([]string, 0, 2)
+	for _, dir := range []sniffer.Direction{sniffer.ClientToServer, sniffer.ServerToClient} {
+		cur := s.counts[dir].Load()
+		last := s.last[dir]
+		var frames, lastFrames uint64
+		var ops []string
+		for op, n := range cur.Frames {
+			frames += n
+			lastFrames += last.Frames[op]
+			if n > 0 {
+				ops = append(ops, fmt.Sprintf("%s %d", sniffer.Opcode(op), n))
+			}
+		}
+		p := fmt.Sprintf("%s %d bytes %d frames", dir, cur.Bytes, frames)
+		if len(ops) > 0 {
+			p += " (" + strings.Join(ops, ", ") + ")"
+		}
+		if elapsed > 0 {
+			p += fmt.Sprintf(" %.0f bytes/s %.1f frames/s",
+				float64(cur.Bytes-last.Bytes)/elapsed, float64(frames-lastFrames)/elapsed)
+		}
+		parts = append(parts, p)
+		s.last[dir] = cur
+	}
+	s.lastTime = now
+	return "stats: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// summaryTalkers is the number of remote addresses shown in the summary
+const summaryTalkers = 5
+
+// summary aggregates the connections of the whole run for -summary, its
+// methods are no-ops on a nil receiver
+type summary struct {
+	lock       sync.Mutex
+	conns      uint64
+	bytes      [2]uint64
+	frames     map[sniffer.Opcode]uint64
+	violations uint64
+	errors     uint64
+	talkers    map[string]*talker
+}
+
+// talker is the traffic of a remote host, over all its connections
+type talker struct {
+	host  string
+	conns uint64
+	bytes uint64
+}
+
+func newSummary() *summary {
+	return &summary{
+		frames:  make(map[sniffer.Opcode]uint64),
+		talkers: make(map[string]*talker),
+	}
+}
+
+func (s *summary) addFrame(f *sniffer.Frame) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.frames[f.Opcode]++
+}
+
+func (s *summary) addViolation() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.violations++
+}
+
+// addConn adds the totals of a close event
+func (s *summary) addConn(ev sniffer.ConnEvent) {
+	if s == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(ev.RemoteAddr)
+	if err != nil {
+		host = ev.RemoteAddr
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.conns++
+	s.bytes[sniffer.ClientToServer] += ev.ClientBytes
+	s.bytes[sniffer.ServerToClient] += ev.ServerBytes
+	if ev.Error != "" {
+		s.errors++
+	}
+	t := s.talkers[host]
+	if t == nil {
+		t = &talker{host: host}
+		s.talkers[host] = t
+	}
+	t.conns++
+	t.bytes += ev.ClientBytes + ev.ServerBytes
+}
+
+// WriteTo writes the report
+func (s *summary) WriteTo(w io.Writer) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "summary: %d connections, %s %d bytes %s %d bytes\n", s.conns,
+		sniffer.ClientToServer, s.bytes[sniffer.ClientToServer],
+		sniffer.ServerToClient, s.bytes[sniffer.ServerToClient])
+
+	ops := make([]sniffer.Opcode, 0, len(s.frames))
+	for op := range s.frames {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+	frames := make([]string, 0, len(ops))
+	for _, op := range ops {
+		frames = append(frames, fmt.Sprintf("%s %d", op, s.frames[op]))
+	}
+	fmt.Fprintf(&b, "frames: %s\n", strings.Join(frames, ", "))
+
+	talkers := make([]*talker, 0, len(s.talkers))
+	for _, t := range s.talkers {
+		talkers = append(talkers, t)
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].bytes != talkers[j].bytes {
+			return talkers[i].bytes > talkers[j].bytes
+		}
+		return talkers[i].host < talkers[j].host
+	})
+	if len(talkers) > summaryTalkers {
+		talkers = talkers[:summaryTalkers]
+	}
+	for _, t := range talkers {
+		fmt.Fprintf(&b, "talker: %s %d bytes %d connections\n", t.host, t.bytes, t.conns)
+	}
+	fmt.Fprintf(&b, "violations: %d, read errors: %d\n", s.violations, s.errors)
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
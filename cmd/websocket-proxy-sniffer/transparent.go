@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// transparentProxy routes each request to the destination the client asked
+// for, either through a CONNECT tunnel or with the Host header, instead of a
+// configured target. This lets the sniffer be used as HTTP_PROXY.
+//
+// Security: this is an open forward proxy. Anyone who can reach the listener
+// can make it connect to any host it can reach, including internal services,
+// and every plain text session through it is recorded. Only bind it to
+// trusted interfaces. TLS tunnels are relayed without being decrypted; they
+// are never sniffed since that would require impersonating the destination.
+type transparentProxy struct {
+	next        http.Handler
+	connContext func(ctx context.Context, c net.Conn) context.Context
+	// dial connects the tunnels that are relayed
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newTransparentProxy(next http.Handler,
+	connContext func(ctx context.Context, c net.Conn) context.Context,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)) *transparentProxy {
+	return &transparentProxy{next: next, connContext: connContext, dial: dial}
+}
+
+func (p *transparentProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// websockets over HTTP/2 use CONNECT too, but they aren't tunnels
+	if r.Method == http.MethodConnect && !sniffer.IsExtendedConnect(r) {
+		p.connect(w, r)
+		return
+	}
+	// absolute-form requests from proxy clients carry the host in the url
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "missing destination host", http.StatusBadRequest)
+		return
+	}
+	u := &url.URL{Scheme: "http", Host: host}
+	ctx := context.WithValue(r.Context(), targetKey{}, u)
+	p.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// connect opens a tunnel to the CONNECT destination. Plain text tunnels are
+// served as a new http connection routed to the destination, so websocket
+// handshakes inside them go through the regular sniffing path
+func (p *transparentProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnels not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	tunnel := &bufferedConn{Conn: conn, r: buf.Reader}
+
+	// a tls client hello starts with a handshake record
+	first, err := buf.Reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if first[0] == 0x16 {
+		p.relay(tunnel, r.Host)
+		return
+	}
+
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	srv := &http.Server{
+		Handler:     newRouter([]route{{target: u}}, p.next),
+		ConnContext: p.connContext,
+	}
+	srv.Serve(newSingleConnListener(tunnel))
+}
+
+// relay copies bytes between the tunnel and the destination without sniffing
+func (p *transparentProxy) relay(tunnel net.Conn, host string) {
+	defer tunnel.Close()
+	upstream, err := p.dial(context.Background(), "tcp", host)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, tunnel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(tunnel, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// bufferedConn reads through the bufio.Reader returned by Hijack, which may
+// already hold bytes sent by the client
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// singleConnListener accepts a single connection and then blocks until that
+// connection is closed, which makes http.Server.Serve return
+type singleConnListener struct {
+	conn chan net.Conn
+	done chan struct{}
+	addr net.Addr
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conn: make(chan net.Conn, 1),
+		done: make(chan struct{}),
+		addr: conn.LocalAddr(),
+	}
+	l.conn <- &notifyConn{Conn: conn, done: l.done}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conn:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// notifyConn closes done when the connection is closed
+type notifyConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
@@ -1,3 +1,3 @@
 module github.com/igolaizola/websocket-proxy-sniffer
 
-go 1.14
+go 1.16
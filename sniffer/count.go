@@ -0,0 +1,82 @@
+package sniffer
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// FrameCounts are the totals of a direction counted by FrameCounters, they
+// are updated atomically so they can be read with Load while traffic flows
+type FrameCounts struct {
+	Bytes uint64
+	// Frames is indexed by opcode
+	Frames [16]uint64
+}
+
+// Load returns a copy of the counts
+func (c *FrameCounts) Load() FrameCounts {
+	var l FrameCounts
+	l.Bytes = atomic.LoadUint64(&c.Bytes)
+	for i := range c.Frames {
+		l.Frames[i] = atomic.LoadUint64(&c.Frames[i])
+	}
+	return l
+}
+
+// FrameCounter is an io.Writer that counts the frames of the websocket stream
+// written to it. Only the headers are looked at, payloads are skipped without
+// being copied or buffered, so it can be passed to TeeConn to measure the
+// traffic of a connection at little cost. It must not be written to
+// concurrently, many counters may share the same counts
+type FrameCounter struct {
+	counts *FrameCounts
+	// hdr holds the start of a header split between writes
+	hdr [14]byte
+	n   int
+	// skip is what is left of the current frame
+	skip uint64
+}
+
+// NewFrameCounter returns a counter that adds to counts
+func NewFrameCounter(counts *FrameCounts) *FrameCounter {
+	return &FrameCounter{counts: counts}
+}
+
+// Write counts the frames starting in p, it never fails
+func (c *FrameCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	atomic.AddUint64(&c.counts.Bytes, uint64(n))
+	for len(p) > 0 {
+		if c.skip >= uint64(len(p)) {
+			c.skip -= uint64(len(p))
+			break
+		}
+		p = p[c.skip:]
+		c.skip = 0
+		k := copy(c.hdr[c.n:], p)
+		size, ok := frameSize(c.hdr[:c.n+k])
+		if !ok {
+			c.n += k
+			break
+		}
+		atomic.AddUint64(&c.counts.Frames[c.hdr[0]&0x0f], 1)
+		// the bytes of the header that came in earlier writes are gone
+		c.skip = size - uint64(c.n)
+		c.n = 0
+	}
+	return n, nil
+}
+
+type countKey struct{}
+
+// CountOnly is a wrapper around http.Handler that makes the sniffer under h
+// count the frames of the connections it hijacks into counts, indexed by
+// Direction, instead of passing them to the OnHijacked callback. The callback
+// is still called, its readers get no data and return an error once the
+// connection is done. An onFrame is ignored, frames are copied as they come
+func CountOnly(h http.Handler, counts *[2]FrameCounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), countKey{}, counts)))
+	})
+}
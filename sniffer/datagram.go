@@ -0,0 +1,161 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// datagramQueue is how many events a DatagramSink holds while they are sent
+const datagramQueue = 1024
+
+// datagramRedial is how long a DatagramSink waits to dial again after failing
+const datagramRedial = time.Second
+
+// DatagramSink publishes every event as a json datagram, to a UDP address or a
+// unixgram socket for live tools to follow the traffic. It never blocks:
+// events are sent by their own goroutine, and they are dropped when its queue
+// is full, nobody is listening or they can't be sent. Events larger than the
+// maximum size get their payload truncated
+type DatagramSink struct {
+	network string
+	addr    string
+	max     int
+
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewDatagramSink returns a sink sending datagrams of up to max bytes to addr,
+// network is udp or unixgram. The address is dialed when the first event is
+// sent, and dialed again after errors, so the listener can come and go
+func NewDatagramSink(network, addr string, max int) *DatagramSink {
+	s := &DatagramSink{
+		network: network,
+		addr:    addr,
+		max:     max,
+		queue:   make(chan []byte, datagramQueue),
+		done:    make(chan struct{}),
+	}
+	go s.send()
+	return s
+}
+
+// WriteFrame queues ev, it never fails
+func (s *DatagramSink) WriteFrame(ev FrameEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil
+	}
+	if len(data) > s.max {
+		if data = s.truncate(ev, len(data)-s.max); data == nil {
+			return nil
+		}
+	}
+	s.push(data)
+	return nil
+}
+
+// truncate shortens the payload of ev by at least excess bytes of json, it
+// returns nil if the event can't be made to fit
+func (s *DatagramSink) truncate(ev FrameEvent, excess int) []byte {
+	ev.Truncated = true
+	for excess > 0 && ev.Payload != "" {
+		n := len(ev.Payload) - excess
+		if n < 0 {
+			n = 0
+		}
+		if ev.Opcode == OpText.String() && ev.Rsv == 0 {
+			for n > 0 && !utf8.RuneStart(ev.Payload[n]) {
+				n--
+			}
+		} else {
+			// keep whole base64 quanta
+			n -= n % 4
+		}
+		ev.Payload = ev.Payload[:n]
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return nil
+		}
+		if excess = len(data) - s.max; excess <= 0 {
+			return data
+		}
+	}
+	return nil
+}
+
+// WriteConn queues ev, the handshake headers are left out if they don't fit
+func (s *DatagramSink) WriteConn(ev ConnEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil
+	}
+	if len(data) > s.max {
+		ev.RequestHeader, ev.ResponseHeader = nil, nil
+		ev.Cookies, ev.SetCookies = nil, nil
+		if data, err = json.Marshal(ev); err != nil || len(data) > s.max {
+			return nil
+		}
+	}
+	s.push(data)
+	return nil
+}
+
+func (s *DatagramSink) push(data []byte) {
+	select {
+	case <-s.done:
+	case s.queue <- data:
+	default:
+		metrics.addUnpublished()
+	}
+}
+
+func (s *DatagramSink) send() {
+	var conn net.Conn
+	var failed time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var data []byte
+		select {
+		case <-s.done:
+			return
+		case data = <-s.queue:
+		}
+		if conn == nil {
+			if time.Since(failed) < datagramRedial {
+				metrics.addUnpublished()
+				continue
+			}
+			c, err := net.Dial(s.network, s.addr)
+			if err != nil {
+				failed = time.Now()
+				metrics.addUnpublished()
+				continue
+			}
+			conn = c
+		}
+		if _, err := conn.Write(data); err != nil {
+			metrics.addUnpublished()
+			// unixgram sockets are gone for good once their reader closes
+			if s.network != "udp" {
+				conn.Close()
+				conn = nil
+				failed = time.Now()
+			}
+		}
+	}
+}
+
+// Close stops sending events, the queued ones are dropped
+func (s *DatagramSink) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
@@ -0,0 +1,130 @@
+package sniffer
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	rsv1 = 0x4
+	// deflateWindow is the maximum LZ77 window used by permessage-deflate
+	deflateWindow = 32768
+)
+
+// deflateTail is removed from the end of every compressed message, it must
+// be appended back along with a final empty block before inflating
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflateParams are the permessage-deflate parameters of RFC 7692
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// parseDeflate looks for a negotiated permessage-deflate extension in the
+// Sec-WebSocket-Extensions handshake header
+func parseDeflate(h http.Header) (deflateParams, bool) {
+	for _, v := range h[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			var p deflateParams
+			for _, param := range params[1:] {
+				switch strings.TrimSpace(param) {
+				case "server_no_context_takeover":
+					p.serverNoContextTakeover = true
+				case "client_no_context_takeover":
+					p.clientNoContextTakeover = true
+				}
+			}
+			return p, true
+		}
+	}
+	return deflateParams{}, false
+}
+
+// Compressed reports whether the payload of a data frame is compressed with
+// permessage-deflate
+func (f *Frame) Compressed() bool {
+	return f.Rsv&rsv1 != 0 && !f.Opcode.IsControl()
+}
+
+// Inflater decompresses the messages of one direction of a connection. With
+// context takeover the LZ77 window persists across messages, this is emulated
+// by using the last decompressed bytes as the dictionary of the next message
+type Inflater struct {
+	contextTakeover bool
+	// r is the decompressor of every message, reset with the dictionary
+	r    io.Reader
+	dict []byte
+	// err is returned for every message once one couldn't be inflated with
+	// context takeover, the ones after it refer to the bytes it lost
+	err error
+}
+
+// NewInflater returns the Inflater of the given direction of a connection
+// from its handshake response headers, or nil if permessage-deflate wasn't
+// negotiated
+func NewInflater(h http.Header, dir Direction) *Inflater {
+	p, ok := parseDeflate(h)
+	if !ok {
+		return nil
+	}
+	noContextTakeover := p.serverNoContextTakeover
+	if dir == ClientToServer {
+		noContextTakeover = p.clientNoContextTakeover
+	}
+	return &Inflater{contextTakeover: !noContextTakeover}
+}
+
+// Inflate decompresses the payload of a compressed message in place and
+// clears its RSV1 bit, other messages are left untouched. Messages must be
+// inflated in the order they were sent
+func (i *Inflater) Inflate(f *Frame) error {
+	if !f.Compressed() {
+		return nil
+	}
+	data, err := i.inflate(f.Payload)
+	if err != nil {
+		return err
+	}
+	f.Payload = data
+	f.Rsv &^= rsv1
+	return nil
+}
+
+func (i *Inflater) inflate(payload []byte) ([]byte, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	compressed := make([]byte, 0, len(payload)+len(deflateTail))
+	compressed = append(compressed, payload...)
+	compressed = append(compressed, deflateTail...)
+	src := bytes.NewReader(compressed)
+	if i.r == nil {
+		i.r = flate.NewReaderDict(src, i.dict)
+	} else if err := i.r.(flate.Resetter).Reset(src, i.dict); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(i.r)
+	if err != nil {
+		if i.contextTakeover {
+			i.err = fmt.Errorf("deflate context lost to a previous message: %w", err)
+		}
+		return nil, err
+	}
+	if i.contextTakeover {
+		i.dict = append(i.dict, data...)
+		if len(i.dict) > deflateWindow {
+			i.dict = i.dict[len(i.dict)-deflateWindow:]
+		}
+	}
+	return data, nil
+}
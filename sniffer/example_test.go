@@ -0,0 +1,38 @@
+package sniffer_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// The client streams are shorter than, as long as and longer than the cap.
+// Only the first 4 bytes of each direction are teed, but the client always
+// gets back everything it sent
+func ExampleTeeConnN() {
+	for _, data := range []string{"abc", "abcd", "abcdefgh"} {
+		client, server := net.Pipe()
+		var in, out bytes.Buffer
+		conn := sniffer.TeeConnN(server, &in, &out, 4)
+		echoed := make(chan []byte)
+		go func() {
+			client.Write([]byte(data))
+			b, _ := ioutil.ReadAll(client)
+			echoed <- b
+		}()
+		b := make([]byte, len(data))
+		io.ReadFull(conn, b)
+		conn.Write(b)
+		conn.Close()
+		fmt.Printf("sent %q, echoed %q, teed in %q and out %q\n", data,
+			<-echoed, in.String(), out.String())
+	}
+	// Output:
+	// sent "abc", echoed "abc", teed in "abc" and out "abc"
+	// sent "abcd", echoed "abcd", teed in "abcd" and out "abcd"
+	// sent "abcdefgh", echoed "abcdefgh", teed in "abcd" and out "abcd"
+}
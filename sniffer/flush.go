@@ -0,0 +1,77 @@
+package sniffer
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// FlushWriter buffers the writes to an underlying writer, such as a file, so
+// frequent small writes don't each cost a system call. The buffer is flushed
+// when it fills up, every interval if it isn't zero, and on Close
+type FlushWriter struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+	buf  *bufio.Writer
+	stop chan struct{}
+}
+
+// NewFlushWriter returns a FlushWriter writing to w
+func NewFlushWriter(w io.WriteCloser, interval time.Duration) *FlushWriter {
+	fw := &FlushWriter{w: w, buf: bufio.NewWriter(w), stop: make(chan struct{})}
+	if interval > 0 {
+		go fw.flushLoop(interval)
+	}
+	return fw
+}
+
+func (fw *FlushWriter) flushLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-fw.stop:
+			return
+		case <-t.C:
+			fw.Flush()
+		}
+	}
+}
+
+func (fw *FlushWriter) Write(p []byte) (int, error) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.buf.Write(p)
+}
+
+// Flush writes the buffered data to the underlying writer, and flushes it too
+// if it has a Flush method, like gzip.Writer does
+func (fw *FlushWriter) Flush() error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if err := fw.buf.Flush(); err != nil {
+		return err
+	}
+	if f, ok := fw.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close flushes the buffer and closes the underlying writer
+func (fw *FlushWriter) Close() error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	select {
+	case <-fw.stop:
+		return nil
+	default:
+	}
+	close(fw.stop)
+	err := fw.buf.Flush()
+	if cerr := fw.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
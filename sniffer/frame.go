@@ -0,0 +1,277 @@
+package sniffer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds the reader maximum size
+var ErrFrameTooLarge = errors.New("websocket: frame too large")
+
+// ErrMessageTooLarge is returned when a reassembled message exceeds the reader
+// maximum size
+var ErrMessageTooLarge = errors.New("websocket: message too large")
+
+// ErrInvalidLength is returned for 64 bit payload lengths with the most
+// significant bit set, which RFC 6455 forbids
+var ErrInvalidLength = errors.New("websocket: invalid payload length")
+
+// Opcode is the type of a WebSocket frame as defined in RFC 6455
+type Opcode byte
+
+// WebSocket opcodes
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case OpContinuation:
+		return "CONTINUATION"
+	case OpText:
+		return "TEXT"
+	case OpBinary:
+		return "BINARY"
+	case OpClose:
+		return "CLOSE"
+	case OpPing:
+		return "PING"
+	case OpPong:
+		return "PONG"
+	default:
+		return fmt.Sprintf("OPCODE(%#x)", byte(o))
+	}
+}
+
+// Frame is a single WebSocket frame
+type Frame struct {
+	Fin bool
+	// Rsv holds the RSV1, RSV2 and RSV3 bits in its three lowest bits
+	Rsv     byte
+	Opcode  Opcode
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+// Close status codes defined in RFC 6455 section 7.4.1
+const (
+	// CloseNormal is sent for a connection that is done
+	CloseNormal = 1000
+	// CloseGoingAway is sent for an endpoint that is going away
+	CloseGoingAway = 1001
+	// CloseNoStatus is the code reported for close frames without a status code
+	CloseNoStatus = 1005
+)
+
+// CloseStatus decodes the status code and reason of a close frame, frames
+// without payload report CloseNoStatus
+func (f *Frame) CloseStatus() (code uint16, reason string) {
+	if len(f.Payload) < 2 {
+		return CloseNoStatus, ""
+	}
+	return binary.BigEndian.Uint16(f.Payload), string(f.Payload[2:])
+}
+
+// FrameReader reads fully-assembled WebSocket frames from a stream of bytes,
+// no matter how the bytes are split across reads
+type FrameReader struct {
+	r      *bufio.Reader
+	unmask bool
+	// MaxSize is the maximum payload length accepted, zero means no limit
+	MaxSize uint64
+}
+
+// NewFrameReader returns a FrameReader, unmask must be set when reading client
+// to server frames, which are masked per RFC 6455
+func NewFrameReader(r io.Reader, unmask bool) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), unmask: unmask}
+}
+
+// NewFrameReaderSize is like NewFrameReader using a read buffer of the given
+// size, payloads are read into their own buffer regardless of this size
+func NewFrameReaderSize(r io.Reader, unmask bool, size int) *FrameReader {
+	return &FrameReader{r: bufio.NewReaderSize(r, size), unmask: unmask}
+}
+
+// ReadFrame blocks until a whole frame has been read
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	f, length, err := fr.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return fr.readPayload(f, length)
+}
+
+// readHeader reads the header of the next frame, up to the mask key, and
+// returns its payload length
+func (fr *FrameReader) readHeader() (*Frame, uint64, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	f := &Frame{
+		Fin:    header[0]&0x80 != 0,
+		Rsv:    header[0] >> 4 & 0x07,
+		Opcode: Opcode(header[0] & 0x0f),
+		Masked: header[1]&0x80 != 0,
+	}
+
+	// payload length uses 7 bits, 7+16 bits or 7+64 bits
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(fr.r, ext[:]); err != nil {
+			return nil, 0, unexpected(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(fr.r, ext[:]); err != nil {
+			return nil, 0, unexpected(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, 0, ErrInvalidLength
+		}
+	}
+
+	if fr.MaxSize > 0 && length > fr.MaxSize {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+
+	if f.Masked {
+		if _, err := io.ReadFull(fr.r, f.MaskKey[:]); err != nil {
+			return nil, 0, unexpected(err)
+		}
+	}
+	return f, length, nil
+}
+
+// readPayload reads the length bytes of payload of f
+func (fr *FrameReader) readPayload(f *Frame, length uint64) (*Frame, error) {
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(fr.r, f.Payload); err != nil {
+		return nil, unexpected(err)
+	}
+	if f.Masked && fr.unmask {
+		maskBytes(f.MaskKey, f.Payload)
+	}
+	return f, nil
+}
+
+// frameSize returns the total size of the frame starting at b or false if b
+// doesn't contain the whole header yet
+func frameSize(b []byte) (uint64, bool) {
+	if len(b) < 2 {
+		return 0, false
+	}
+	size := uint64(2)
+	length := uint64(b[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(b) < 4 {
+			return 0, false
+		}
+		size += 2
+		length = uint64(binary.BigEndian.Uint16(b[2:]))
+	case 127:
+		if len(b) < 10 {
+			return 0, false
+		}
+		size += 8
+		length = binary.BigEndian.Uint64(b[2:])
+		if length>>63 != 0 {
+			// just the header, reading it reports the error
+			return size, true
+		}
+	}
+	if b[1]&0x80 != 0 {
+		size += 4
+	}
+	return size + length, true
+}
+
+// WriteFrame encodes f into w, the payload is masked with f.MaskKey if
+// f.Masked is set
+func WriteFrame(w io.Writer, f *Frame) error {
+	header := make([]byte, 2, 14)
+	if f.Fin {
+		header[0] |= 0x80
+	}
+	header[0] |= (f.Rsv & 0x07) << 4
+	header[0] |= byte(f.Opcode) & 0x0f
+	if f.Masked {
+		header[1] |= 0x80
+	}
+
+	length := len(f.Payload)
+	switch {
+	case length < 126:
+		header[1] |= byte(length)
+	case length <= 0xffff:
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] |= 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	payload := f.Payload
+	if f.Masked {
+		header = append(header, f.MaskKey[:]...)
+		payload = make([]byte, length)
+		copy(payload, f.Payload)
+		maskBytes(f.MaskKey, payload)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Mask marks the frame as masked with a new random key, as client frames
+// must be, the payload is masked when written
+func (f *Frame) Mask() error {
+	return f.MaskWith(rand.Reader)
+}
+
+// MaskWith is like Mask but the key is read from r, a fixed source makes the
+// masked bytes predictable
+func (f *Frame) MaskWith(r io.Reader) error {
+	if _, err := io.ReadFull(r, f.MaskKey[:]); err != nil {
+		return err
+	}
+	f.Masked = true
+	return nil
+}
+
+// maskBytes applies the XOR mask to b in place, it is used both to mask and to
+// unmask since the operation is its own inverse
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// unexpected converts an EOF in the middle of a frame into an
+// io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IsExtendedConnect reports whether the request is a websocket handshake over
+// HTTP/2 as defined in RFC 8441
+func IsExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect &&
+		strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// http2Upgrade turns an extended CONNECT into the equivalent HTTP/1.1
+// upgrade and returns a ResponseWriter whose Hijack returns the HTTP/2 stream
+// as a net.Conn. Handlers written for HTTP/1.1, such as the reverse proxy,
+// and the sniffer's hijack path work with it unchanged
+func http2Upgrade(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	body := r.Body
+	r = r.Clone(r.Context())
+	r.Method = http.MethodGet
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	r.Body, r.ContentLength = http.NoBody, 0
+	r.Header.Del(":protocol")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	// HTTP/2 handshakes have no key, the upstream needs one
+	r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(nonce[:]))
+	return &http2Hijacker{ResponseWriter: w, request: r, body: body}, r, nil
+}
+
+type http2Hijacker struct {
+	http.ResponseWriter
+	request *http.Request
+	body    io.ReadCloser
+	// header replaces the stream headers once hijacked, the HTTP/1.1
+	// response headers written by the handler don't belong there
+	header http.Header
+}
+
+func (h *http2Hijacker) Header() http.Header {
+	if h.header != nil {
+		return h.header
+	}
+	return h.ResponseWriter.Header()
+}
+
+func (h *http2Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	flusher, ok := h.ResponseWriter.(http.Flusher)
+	if !ok {
+		return nil, nil, errors.New("http2: streaming not supported")
+	}
+	h.header = make(http.Header)
+	conn := &http2Conn{
+		w:      h.ResponseWriter,
+		flush:  flusher.Flush,
+		body:   h.body,
+		local:  stringAddr(h.request.Host),
+		remote: stringAddr(h.request.RemoteAddr),
+	}
+	if addr, ok := h.request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	}
+	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return conn, buf, nil
+}
+
+// http2Conn is an HTTP/2 stream used as a connection. The HTTP/1.1 response
+// written first is translated into the HTTP/2 response headers, after that
+// writes go to the response body and reads come from the request body.
+// Deadlines aren't supported
+type http2Conn struct {
+	w      http.ResponseWriter
+	flush  func()
+	body   io.ReadCloser
+	local  net.Addr
+	remote net.Addr
+	// head holds the HTTP/1.1 response until it is complete
+	head    []byte
+	headers bool
+}
+
+func (c *http2Conn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *http2Conn) Write(p []byte) (int, error) {
+	n := len(p)
+	if !c.headers {
+		c.head = append(c.head, p...)
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			return n, nil
+		}
+		p = c.head[end+4:]
+		if err := c.writeHeader(c.head[:end+4]); err != nil {
+			return 0, err
+		}
+		c.head, c.headers = nil, true
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	c.flush()
+	return n, nil
+}
+
+// writeHeader sends the HTTP/2 response for an HTTP/1.1 101, which is a 200
+func (c *http2Conn) writeHeader(head []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range resp.Header {
+		switch k {
+		// connection specific headers are forbidden in HTTP/2
+		case "Connection", "Upgrade", "Sec-Websocket-Accept":
+		default:
+			c.w.Header()[k] = v
+		}
+	}
+	code := resp.StatusCode
+	if code == http.StatusSwitchingProtocols {
+		code = http.StatusOK
+	}
+	c.w.WriteHeader(code)
+	c.flush()
+	return nil
+}
+
+func (c *http2Conn) Close() error                       { return c.body.Close() }
+func (c *http2Conn) LocalAddr() net.Addr                { return c.local }
+func (c *http2Conn) RemoteAddr() net.Addr               { return c.remote }
+func (c *http2Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *http2Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *http2Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stringAddr is a net.Addr known only by its string
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
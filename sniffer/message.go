@@ -0,0 +1,76 @@
+package sniffer
+
+import "fmt"
+
+// IsControl reports whether the opcode is a control one, control frames can't
+// be fragmented and may arrive in the middle of a fragmented message
+func (o Opcode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+// MessageReader reassembles messages split into a leading frame followed by
+// continuation frames
+type MessageReader struct {
+	frames *FrameReader
+	// OnFrame, if set, is called for every frame as it is read
+	OnFrame func(f *Frame)
+	// MaxSize is the maximum payload length of a reassembled message, zero
+	// means no limit
+	MaxSize uint64
+	// msg is the message being reassembled
+	msg *Frame
+}
+
+// NewMessageReader returns a MessageReader reading from frames
+func NewMessageReader(frames *FrameReader) *MessageReader {
+	return &MessageReader{frames: frames}
+}
+
+// ReadMessage blocks until a whole message has been read. The returned frame
+// has the opcode and rsv bits of the leading frame and the payloads of all
+// the fragments. Control frames are returned as soon as they arrive without
+// breaking the reassembly in progress. Messages growing past MaxSize are
+// dropped and ErrMessageTooLarge is returned
+func (mr *MessageReader) ReadMessage() (*Frame, error) {
+	for {
+		f, err := mr.frames.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if mr.OnFrame != nil {
+			mr.OnFrame(f)
+		}
+		switch {
+		case f.Opcode.IsControl():
+			return f, nil
+		case f.Opcode == OpContinuation && mr.msg == nil:
+			// protocol error, there is nothing to continue
+			return f, nil
+		case f.Opcode == OpContinuation:
+			if err := mr.checkSize(len(mr.msg.Payload) + len(f.Payload)); err != nil {
+				return nil, err
+			}
+			mr.msg.Payload = append(mr.msg.Payload, f.Payload...)
+		default:
+			if err := mr.checkSize(len(f.Payload)); err != nil {
+				return nil, err
+			}
+			mr.msg = f
+		}
+		if f.Fin {
+			msg := mr.msg
+			msg.Fin = true
+			mr.msg = nil
+			return msg, nil
+		}
+	}
+}
+
+// checkSize drops the message being reassembled if size exceeds MaxSize
+func (mr *MessageReader) checkSize(size int) error {
+	if mr.MaxSize == 0 || uint64(size) <= mr.MaxSize {
+		return nil
+	}
+	mr.msg = nil
+	return fmt.Errorf("%w: more than %d bytes", ErrMessageTooLarge, mr.MaxSize)
+}
@@ -0,0 +1,284 @@
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics is nil unless SetMetrics is called, Metrics methods are no-ops on
+// a nil receiver so callers don't need to check
+var metrics *Metrics
+
+// SetMetrics makes the package count the sniffed traffic into m, it must be
+// called before any connection is sniffed
+func SetMetrics(m *Metrics) {
+	metrics = m
+}
+
+// Metrics collects counters of the sniffed traffic and exposes them in the
+// Prometheus text format
+type Metrics struct {
+	// 64 bit fields first so atomic operations are aligned on 32 bit
+	// platforms
+	connections uint64
+	active      int64
+	bytes       [2]uint64
+	filtered    uint64
+	dropped     [2]uint64
+	// unpublished are the events a DatagramSink couldn't send
+	unpublished uint64
+
+	lock       sync.Mutex
+	frames     map[Opcode]uint64
+	closeCodes map[uint16]uint64
+	violations map[string]uint64
+	// frameSizes is websocket_sniffer_frame_payload_bytes, the payload
+	// length of every frame, labeled by direction
+	frameSizes [2]*histogram
+	// pingRTTs is websocket_sniffer_ping_rtt_seconds, the time between a
+	// ping and its pong, labeled by the direction of the ping
+	pingRTTs [2]*histogram
+}
+
+// directionLabels are the values of the direction label
+var directionLabels = [2]string{
+	ClientToServer: "client_to_server",
+	ServerToClient: "server_to_client",
+}
+
+// frameSizeBuckets are the upper bounds of the frame payload size buckets,
+// from 64 bytes to 16 MiB
+var frameSizeBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10,
+	64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// pingRTTBuckets are the upper bounds of the ping latency buckets, in seconds
+var pingRTTBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1,
+	2.5, 5, 10}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		frames:     make(map[Opcode]uint64),
+		closeCodes: make(map[uint16]uint64),
+		violations: make(map[string]uint64),
+		frameSizes: [2]*histogram{newHistogram(frameSizeBuckets),
+			newHistogram(frameSizeBuckets)},
+		pingRTTs: [2]*histogram{newHistogram(pingRTTBuckets),
+			newHistogram(pingRTTBuckets)},
+	}
+}
+
+// histogram counts observations in buckets by upper bound, the last bucket
+// being +Inf. It is guarded by the lock of its Metrics
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write writes the series of the histogram, with cumulative buckets as
+// Prometheus expects. labels are prepended to the le label of the buckets
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var n uint64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels,
+			strconv.FormatFloat(bound, 'f', -1, 64), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels,
+		strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func (m *Metrics) connOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.connections, 1)
+	atomic.AddInt64(&m.active, 1)
+}
+
+func (m *Metrics) connClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.active, -1)
+}
+
+func (m *Metrics) addBytes(dir Direction, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	atomic.AddUint64(&m.bytes[dir], uint64(n))
+}
+
+// AddFrame counts a frame sent in the given direction by opcode and payload
+// size, and close frames by status code
+func (m *Metrics) AddFrame(dir Direction, f *Frame) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.frames[f.Opcode]++
+	m.frameSizes[dir].observe(float64(len(f.Payload)))
+	if f.Opcode == OpClose {
+		code, _ := f.CloseStatus()
+		m.closeCodes[code]++
+	}
+}
+
+// AddPingRTT records the latency of a ping sent in the given direction and
+// answered by a pong
+func (m *Metrics) AddPingRTT(dir Direction, rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pingRTTs[dir].observe(rtt.Seconds())
+}
+
+// AddViolation counts a protocol violation of the given kind
+func (m *Metrics) AddViolation(kind string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.violations[kind]++
+}
+
+// AddFiltered counts a message that wasn't logged because of a filter
+func (m *Metrics) AddFiltered() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.filtered, 1)
+}
+
+// addDropped counts bytes the sniffer was too slow to read
+func (m *Metrics) addDropped(dir Direction, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	atomic.AddUint64(&m.dropped[dir], uint64(n))
+}
+
+// addUnpublished counts an event a DatagramSink dropped
+func (m *Metrics) addUnpublished() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.unpublished, 1)
+}
+
+// ServeHTTP serves the counters in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_connections_total Hijacked connections.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_connections_total counter")
+	fmt.Fprintf(w, "websocket_sniffer_connections_total %d\n",
+		atomic.LoadUint64(&m.connections))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_active_connections Hijacked connections currently open.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_active_connections gauge")
+	fmt.Fprintf(w, "websocket_sniffer_active_connections %d\n",
+		atomic.LoadInt64(&m.active))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_bytes_total Bytes proxied by direction.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_bytes_total counter")
+	fmt.Fprintf(w, "websocket_sniffer_bytes_total{direction=\"client_to_server\"} %d\n",
+		atomic.LoadUint64(&m.bytes[ClientToServer]))
+	fmt.Fprintf(w, "websocket_sniffer_bytes_total{direction=\"server_to_client\"} %d\n",
+		atomic.LoadUint64(&m.bytes[ServerToClient]))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_filtered_total Messages not logged because of -filter.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_filtered_total counter")
+	fmt.Fprintf(w, "websocket_sniffer_filtered_total %d\n",
+		atomic.LoadUint64(&m.filtered))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_dropped_bytes_total Bytes proxied but not sniffed because of a slow consumer.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_dropped_bytes_total counter")
+	fmt.Fprintf(w, "websocket_sniffer_dropped_bytes_total{direction=\"client_to_server\"} %d\n",
+		atomic.LoadUint64(&m.dropped[ClientToServer]))
+	fmt.Fprintf(w, "websocket_sniffer_dropped_bytes_total{direction=\"server_to_client\"} %d\n",
+		atomic.LoadUint64(&m.dropped[ServerToClient]))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_unpublished_total Events dropped by -publish.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_unpublished_total counter")
+	fmt.Fprintf(w, "websocket_sniffer_unpublished_total %d\n",
+		atomic.LoadUint64(&m.unpublished))
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_frames_total Frames seen by opcode.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_frames_total counter")
+	m.lock.Lock()
+	ops := make([]Opcode, 0, len(m.frames))
+	for op := range m.frames {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+	for _, op := range ops {
+		fmt.Fprintf(w, "websocket_sniffer_frames_total{opcode=%q} %d\n",
+			op, m.frames[op])
+	}
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_close_frames_total Close frames by status code.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_close_frames_total counter")
+	codes := make([]int, 0, len(m.closeCodes))
+	for code := range m.closeCodes {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "websocket_sniffer_close_frames_total{code=\"%d\"} %d\n",
+			code, m.closeCodes[uint16(code)])
+	}
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_protocol_violations_total RFC 6455 violations by kind.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_protocol_violations_total counter")
+	kinds := make([]string, 0, len(m.violations))
+	for kind := range m.violations {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "websocket_sniffer_protocol_violations_total{kind=%q} %d\n",
+			kind, m.violations[kind])
+	}
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_frame_payload_bytes Frame payload sizes by direction.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_frame_payload_bytes histogram")
+	for dir, h := range m.frameSizes {
+		h.write(w, "websocket_sniffer_frame_payload_bytes",
+			fmt.Sprintf("direction=%q", directionLabels[dir]))
+	}
+
+	fmt.Fprintln(w, "# HELP websocket_sniffer_ping_rtt_seconds Ping to pong latency by direction of the ping.")
+	fmt.Fprintln(w, "# TYPE websocket_sniffer_ping_rtt_seconds histogram")
+	for dir, h := range m.pingRTTs {
+		h.write(w, "websocket_sniffer_ping_rtt_seconds",
+			fmt.Sprintf("direction=%q", directionLabels[dir]))
+	}
+	m.lock.Unlock()
+}
@@ -0,0 +1,188 @@
+package sniffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CaptureVersion is the version of the ndjson capture format written by
+// CaptureWriter, readers refuse captures of a newer version
+const CaptureVersion = 1
+
+// types of CaptureRecord
+const (
+	CaptureHandshake = "handshake"
+	CaptureFrame     = "frame"
+)
+
+// CaptureRecord is a line of an ndjson capture. The first line of a capture is
+// its handshake and every line after it is a frame as it was on the wire,
+// before reassembly or decompression, so the capture can be replayed. A
+// capture may hold whole messages instead, such as redacted ones, they are
+// recorded as uncompressed final frames and replay the same
+//
+//	{"type":"handshake","version":1,"ts":"...","conn_id":"1","remote_addr":"...",
+//	 "url":"/chat","request_header":{...},"response_header":{...}}
+//	{"type":"frame","ts":"...","direction":"client_to_server","fin":true,
+//	 "opcode":"TEXT","payload":"aGVsbG8="}
+type CaptureRecord struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"ts"`
+
+	// Version, ConnID, RemoteAddr, URL and the headers are those of the
+	// handshake record
+	Version        int         `json:"version,omitempty"`
+	ConnID         string      `json:"conn_id,omitempty"`
+	RemoteAddr     string      `json:"remote_addr,omitempty"`
+	URL            string      `json:"url,omitempty"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+
+	// Direction is client_to_server or server_to_client
+	Direction string `json:"direction,omitempty"`
+	Fin       bool   `json:"fin,omitempty"`
+	Rsv       byte   `json:"rsv,omitempty"`
+	Opcode    string `json:"opcode,omitempty"`
+	// Payload is unmasked, base64 in the json
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// Frame returns the frame of a frame record and the direction it was sent in
+func (rec *CaptureRecord) Frame() (*Frame, Direction, error) {
+	if rec.Type != CaptureFrame {
+		return nil, 0, fmt.Errorf("capture: %s record isn't a frame", rec.Type)
+	}
+	var dir Direction
+	switch rec.Direction {
+	case directionLabels[ClientToServer]:
+		dir = ClientToServer
+	case directionLabels[ServerToClient]:
+		dir = ServerToClient
+	default:
+		return nil, 0, fmt.Errorf("capture: unknown direction %q", rec.Direction)
+	}
+	op, ok := opcodeByName[rec.Opcode]
+	if !ok {
+		return nil, 0, fmt.Errorf("capture: unknown opcode %q", rec.Opcode)
+	}
+	f := &Frame{Fin: rec.Fin, Rsv: rec.Rsv, Opcode: op, Payload: rec.Payload}
+	return f, dir, nil
+}
+
+// opcodeByName maps the names of Opcode.String back to the opcodes
+var opcodeByName = func() map[string]Opcode {
+	m := make(map[string]Opcode)
+	for op := Opcode(0); op < 16; op++ {
+		m[op.String()] = op
+	}
+	return m
+}()
+
+// CaptureWriter writes an ndjson capture, its methods may be called
+// concurrently by the two directions of a connection
+type CaptureWriter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewCaptureWriter returns a CaptureWriter writing to w, WriteHandshake must
+// be called before any frame is written
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{enc: json.NewEncoder(w)}
+}
+
+// WriteHandshake writes the handshake record of the request r, answered with
+// the response headers res
+func (c *CaptureWriter) WriteHandshake(r *http.Request, res http.Header, t time.Time) error {
+	return c.write(&CaptureRecord{
+		Type:           CaptureHandshake,
+		Time:           t,
+		Version:        CaptureVersion,
+		ConnID:         ConnID(r),
+		RemoteAddr:     r.RemoteAddr,
+		URL:            r.URL.String(),
+		RequestHeader:  r.Header,
+		ResponseHeader: res,
+	})
+}
+
+// WriteFrame writes the record of a frame sent in the given direction
+func (c *CaptureWriter) WriteFrame(dir Direction, f *Frame, t time.Time) error {
+	return c.write(&CaptureRecord{
+		Type:      CaptureFrame,
+		Time:      t,
+		Direction: directionLabels[dir],
+		Fin:       f.Fin,
+		Rsv:       f.Rsv,
+		Opcode:    f.Opcode.String(),
+		Payload:   f.Payload,
+	})
+}
+
+func (c *CaptureWriter) write(rec *CaptureRecord) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.enc.Encode(rec)
+}
+
+// ErrCaptureVersion is returned for captures written by a newer version
+var ErrCaptureVersion = errors.New("capture: unsupported version")
+
+// CaptureReader reads an ndjson capture
+type CaptureReader struct {
+	dec *json.Decoder
+	// Handshake is the handshake record, read by NewCaptureReader
+	Handshake *CaptureRecord
+}
+
+// NewCaptureReader reads the handshake record of the capture in r
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{dec: json.NewDecoder(bufio.NewReader(r))}
+	rec, err := c.read()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.Type != CaptureHandshake {
+		return nil, fmt.Errorf("capture: starts with a %s record instead of "+
+			"the handshake", rec.Type)
+	}
+	if rec.Version > CaptureVersion {
+		return nil, fmt.Errorf("%w %d", ErrCaptureVersion, rec.Version)
+	}
+	c.Handshake = rec
+	return c, nil
+}
+
+// ReadFrame returns the next frame record and the frame it holds, io.EOF
+// at the end of the capture
+func (c *CaptureReader) ReadFrame() (*CaptureRecord, *Frame, Direction, error) {
+	rec, err := c.read()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	f, dir, err := rec.Frame()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return rec, f, dir, nil
+}
+
+func (c *CaptureReader) read() (*CaptureRecord, error) {
+	var rec CaptureRecord
+	if err := c.dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("capture: %w", err)
+	}
+	return &rec, nil
+}
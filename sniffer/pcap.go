@@ -0,0 +1,279 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pcapSnapLen      = 262144
+	pcapLinkEthernet = 1
+	// keep packets well below the 16 bit ip length limit
+	pcapMaxSegment = 65000
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+var (
+	pcapClientMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	pcapServerMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// PcapWriter writes captured connections as a libpcap file. Ethernet, IP and
+// TCP headers are fabricated so Wireshark can reassemble the streams and hand
+// them to its WebSocket dissector
+type PcapWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewPcapWriter writes the pcap file header to w
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkEthernet)
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// PcapConn is a synthetic tcp connection inside a pcap file
+type PcapConn struct {
+	p          *PcapWriter
+	clientIP   net.IP
+	serverIP   net.IP
+	clientPort uint16
+	serverPort uint16
+	// next sequence number of each side
+	clientSeq uint32
+	serverSeq uint32
+	closed    bool
+}
+
+// Conn starts a new connection between the client and server addresses. A
+// tcp handshake is recorded so the stream has a proper beginning. Addresses
+// that aren't ip:port, such as unix sockets, are replaced with loopback ones
+func (p *PcapWriter) Conn(client, server string) (*PcapConn, error) {
+	clientIP, clientPort := pcapAddr(client, net.IPv4(127, 0, 0, 1), 50000)
+	serverIP, serverPort := pcapAddr(server, net.IPv4(127, 0, 0, 2), 80)
+	if clientIP.To4() == nil || serverIP.To4() == nil {
+		// both endpoints must use the same ip version
+		clientIP, serverIP = clientIP.To16(), serverIP.To16()
+	} else {
+		clientIP, serverIP = clientIP.To4(), serverIP.To4()
+	}
+	c := &PcapConn{
+		p:          p,
+		clientIP:   clientIP,
+		serverIP:   serverIP,
+		clientPort: clientPort,
+		serverPort: serverPort,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := c.packet(true, tcpSyn, nil); err != nil {
+		return nil, err
+	}
+	if err := c.packet(false, tcpSyn|tcpAck, nil); err != nil {
+		return nil, err
+	}
+	if err := c.packet(true, tcpAck, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func pcapAddr(addr string, defIP net.IP, defPort uint16) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return defIP, defPort
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return defIP, defPort
+	}
+	return ip, uint16(n)
+}
+
+// WriteHandshake records the http upgrade. The upstream response isn't
+// seen by the tee, so a minimal 101 response is fabricated which is enough
+// for Wireshark to switch to the WebSocket dissector
+func (c *PcapConn) WriteHandshake(r *http.Request) error {
+	req, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		return err
+	}
+	if _, err := c.In().Write(req); err != nil {
+		return err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	_, err = c.Out().Write([]byte(resp))
+	return err
+}
+
+// In returns a writer for client to server data
+func (c *PcapConn) In() io.Writer {
+	return &pcapStream{conn: c, fromClient: true}
+}
+
+// Out returns a writer for server to client data
+func (c *PcapConn) Out() io.Writer {
+	return &pcapStream{conn: c, fromClient: false}
+}
+
+// Close records the tcp teardown
+func (c *PcapConn) Close() error {
+	c.p.lock.Lock()
+	defer c.p.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if err := c.packet(true, tcpFin|tcpAck, nil); err != nil {
+		return err
+	}
+	return c.packet(false, tcpFin|tcpAck, nil)
+}
+
+type pcapStream struct {
+	conn       *PcapConn
+	fromClient bool
+}
+
+func (s *pcapStream) Write(b []byte) (int, error) {
+	s.conn.p.lock.Lock()
+	defer s.conn.p.lock.Unlock()
+	if s.conn.closed {
+		return 0, fmt.Errorf("pcap: write on closed connection")
+	}
+	n := 0
+	for n < len(b) {
+		end := n + pcapMaxSegment
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := s.conn.packet(s.fromClient, tcpPsh|tcpAck, b[n:end]); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// packet writes a single record, the caller must hold the writer lock
+func (c *PcapConn) packet(fromClient bool, flags byte, payload []byte) error {
+	srcMAC, dstMAC := pcapClientMAC, pcapServerMAC
+	srcIP, dstIP := c.clientIP, c.serverIP
+	srcPort, dstPort := c.clientPort, c.serverPort
+	seq, ack := &c.clientSeq, &c.serverSeq
+	if !fromClient {
+		srcMAC, dstMAC = dstMAC, srcMAC
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], *ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	// syn and fin consume a sequence number like a byte of data
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+
+	var ip, ethType []byte
+	if len(srcIP) == net.IPv4len {
+		ethType = []byte{0x08, 0x00}
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+	} else {
+		ethType = []byte{0x86, 0xdd}
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], srcIP)
+		copy(ip[24:], dstIP)
+	}
+
+	// tcp checksum covers a pseudo header with the addresses
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+
+	frame := make([]byte, 0, 14+len(ip)+len(tcp))
+	frame = append(frame, dstMAC...)
+	frame = append(frame, srcMAC...)
+	frame = append(frame, ethType...)
+	frame = append(frame, ip...)
+	frame = append(frame, tcp...)
+
+	now := time.Now()
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	if _, err := c.p.w.Write(record[:]); err != nil {
+		return err
+	}
+	_, err := c.p.w.Write(frame)
+	return err
+}
+
+// sum adds b to the ones' complement sum s
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b starting from the partial sum s
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
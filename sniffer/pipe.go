@@ -0,0 +1,93 @@
+package sniffer
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errSlowConsumer is returned by a bufferedPipe reader that fell too far
+// behind and lost data
+var errSlowConsumer = errors.New("sniffer: consumer too slow, dropping traffic")
+
+// pipeLimit is the data a bufferedPipe holds for its reader
+const pipeLimit = 4 << 20
+
+// bufferedPipe connects the tee of a proxied connection with the sniffer
+// reading it. Unlike io.Pipe writes never block nor fail, so a slow reader
+// can't stall the proxied traffic. Once the reader is more than limit bytes
+// behind the rest of the stream is dropped, frames can't be told apart after
+// a gap, and the reader gets errSlowConsumer after the data queued so far
+type bufferedPipe struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	dir    Direction
+	limit  int
+	chunks [][]byte
+	queued int
+	// err is returned by Read once the queued data has been read
+	err error
+}
+
+func newBufferedPipe(dir Direction, limit int) *bufferedPipe {
+	p := &bufferedPipe{dir: dir, limit: limit}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.chunks) == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if len(p.chunks) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.chunks[0])
+	if n == len(p.chunks[0]) {
+		p.chunks[0] = nil
+		p.chunks = p.chunks[1:]
+	} else {
+		p.chunks[0] = p.chunks[0][n:]
+	}
+	p.queued -= n
+	return n, nil
+}
+
+// Write queues a copy of b, it always succeeds
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case p.err == errSlowConsumer:
+		metrics.addDropped(p.dir, len(b))
+	case p.err != nil:
+	case p.queued+len(b) > p.limit:
+		p.err = errSlowConsumer
+		metrics.addDropped(p.dir, len(b))
+		p.cond.Broadcast()
+	default:
+		p.chunks = append(p.chunks, append([]byte(nil), b...))
+		p.queued += len(b)
+		p.cond.Broadcast()
+	}
+	return len(b), nil
+}
+
+// Close ends the stream, the reader gets io.EOF after the queued data
+func (p *bufferedPipe) Close() error {
+	return p.CloseWithError(io.EOF)
+}
+
+// CloseWithError ends the stream, the reader gets err after the queued data.
+// Later writes are discarded
+func (p *bufferedPipe) CloseWithError(err error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+	return nil
+}
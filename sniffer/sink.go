@@ -0,0 +1,531 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FrameEvent is a captured frame as emitted by the json sink
+type FrameEvent struct {
+	Time       time.Time `json:"time"`
+	ConnID     string    `json:"conn_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Direction  string    `json:"direction"`
+	Opcode     string    `json:"opcode"`
+	Length     int       `json:"length"`
+	// Payload is the text for text frames and base64 for any other frame
+	Payload string `json:"payload"`
+	// Rsv holds the RSV bits left after decoding the extensions the sniffer
+	// knows, the payload of such frames is opaque and always base64
+	Rsv byte `json:"rsv,omitempty"`
+	// CloseCode and CloseReason are only set for close frames
+	CloseCode   uint16 `json:"close_code,omitempty"`
+	CloseReason string `json:"close_reason,omitempty"`
+	// Header is only set when the event describes a single frame as it was
+	// on the wire instead of a message, without its payload
+	Header *FrameHeader `json:"header,omitempty"`
+	// Truncated is set when the payload has been cut to fit, Length is
+	// still the length of the whole payload
+	Truncated bool `json:"truncated,omitempty"`
+	// Frame is the frame the event was made from, it is nil when the payload
+	// has been left out
+	Frame *Frame `json:"-"`
+}
+
+// FrameHeader are the header fields of a frame, before any extension decoded
+// its payload
+type FrameHeader struct {
+	Fin    bool `json:"fin"`
+	Rsv    byte `json:"rsv"`
+	Masked bool `json:"masked"`
+	// MaskKey is in hex, only set when masked
+	MaskKey string `json:"mask_key,omitempty"`
+	Length  int    `json:"length"`
+}
+
+// NewFrameHeader returns the header of f
+func NewFrameHeader(f *Frame) *FrameHeader {
+	h := &FrameHeader{Fin: f.Fin, Rsv: f.Rsv, Masked: f.Masked, Length: len(f.Payload)}
+	if f.Masked {
+		h.MaskKey = hex.EncodeToString(f.MaskKey[:])
+	}
+	return h
+}
+
+// NewFrameEvent returns the event of a frame seen at t on the connection of r
+func NewFrameEvent(r *http.Request, dir Direction, f *Frame, t time.Time) FrameEvent {
+	ev := FrameEvent{
+		Time:       t,
+		ConnID:     ConnID(r),
+		RemoteAddr: r.RemoteAddr,
+		Direction:  dir.String(),
+		Opcode:     f.Opcode.String(),
+		Length:     len(f.Payload),
+		Rsv:        f.Rsv,
+		Frame:      f,
+	}
+	if f.Opcode == OpText && f.Rsv == 0 {
+		ev.Payload = string(f.Payload)
+	} else {
+		ev.Payload = base64.StdEncoding.EncodeToString(f.Payload)
+	}
+	if f.Opcode == OpClose && f.Rsv == 0 {
+		ev.CloseCode, ev.CloseReason = f.CloseStatus()
+	}
+	return ev
+}
+
+// ConnEvent is a connection being opened or closed
+type ConnEvent struct {
+	Time time.Time `json:"time"`
+	// Event is either open or close
+	Event      string `json:"event"`
+	ConnID     string `json:"conn_id,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	URL        string `json:"url,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+	// RequestHeader and ResponseHeader are the handshake headers, they are
+	// only set when opened
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	// Cookies are the cookies sent by the client and SetCookies the ones set
+	// by the server in the handshake, as name=value
+	Cookies    []string `json:"cookies,omitempty"`
+	SetCookies []string `json:"set_cookies,omitempty"`
+	// the totals and the first close status seen are only set when closed
+	ClientBytes  uint64 `json:"client_bytes,omitempty"`
+	ClientFrames uint64 `json:"client_frames,omitempty"`
+	ServerBytes  uint64 `json:"server_bytes,omitempty"`
+	ServerFrames uint64 `json:"server_frames,omitempty"`
+	CloseCode    uint16 `json:"close_code,omitempty"`
+	// Error is why the connection stopped being sniffed, if it wasn't
+	// closed cleanly
+	Error string `json:"error,omitempty"`
+}
+
+// Connection events
+const (
+	ConnOpen  = "open"
+	ConnClose = "close"
+)
+
+// Sink receives captured frames, it must be safe for concurrent use
+type Sink interface {
+	WriteFrame(ev FrameEvent) error
+}
+
+// ConnSink is implemented by sinks that also record connections opening and
+// closing
+type ConnSink interface {
+	WriteConn(ev ConnEvent) error
+}
+
+// SinkFunc adapts a function to a Sink
+type SinkFunc func(ev FrameEvent) error
+
+// WriteFrame calls f(ev)
+func (f SinkFunc) WriteFrame(ev FrameEvent) error {
+	return f(ev)
+}
+
+// MultiSink writes every event to all of its sinks, even if some of them
+// fail, and returns the first error
+type MultiSink []Sink
+
+// WriteFrame writes ev to all the sinks
+func (m MultiSink) WriteFrame(ev FrameEvent) error {
+	var first error
+	for _, s := range m {
+		if err := s.WriteFrame(ev); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// WriteConn writes ev to the sinks that implement ConnSink
+func (m MultiSink) WriteConn(ev ConnEvent) error {
+	var first error
+	for _, s := range m {
+		cs, ok := s.(ConnSink)
+		if !ok {
+			continue
+		}
+		if err := cs.WriteConn(ev); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// DirectionSink writes to Sink only the frames going in Direction,
+// connection events are always written
+type DirectionSink struct {
+	Sink
+	Direction Direction
+}
+
+// WriteFrame writes ev if it goes in the sink direction
+func (s DirectionSink) WriteFrame(ev FrameEvent) error {
+	if ev.Direction != s.Direction.String() {
+		return nil
+	}
+	return s.Sink.WriteFrame(ev)
+}
+
+// WriteConn writes ev if the sink records connections
+func (s DirectionSink) WriteConn(ev ConnEvent) error {
+	if cs, ok := s.Sink.(ConnSink); ok {
+		return cs.WriteConn(ev)
+	}
+	return nil
+}
+
+// TimeFormat is RFC 3339 with microseconds, used by the text sink
+const TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// NewSink returns a sink writing to w in the given format, either text, a
+// line per frame, or json, a FrameEvent per line
+func NewSink(format string, w io.Writer) (Sink, error) {
+	switch format {
+	case "text":
+		return NewTextSink(w, TextOptions{}), nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return &jsonSink{enc: enc}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// BinaryFormat is how the text sink renders binary payloads
+type BinaryFormat int
+
+// Binary formats
+const (
+	// BinaryHex renders the payload as a single hex string
+	BinaryHex BinaryFormat = iota
+	BinaryBase64
+	// BinaryHexdump renders the payload over several lines with offsets and
+	// the printable characters, like xxd
+	BinaryHexdump
+)
+
+// ParseBinaryFormat returns the format named hex, base64 or hexdump
+func ParseBinaryFormat(s string) (BinaryFormat, error) {
+	switch s {
+	case "hex":
+		return BinaryHex, nil
+	case "base64":
+		return BinaryBase64, nil
+	case "hexdump":
+		return BinaryHexdump, nil
+	default:
+		return 0, fmt.Errorf("unknown binary format %q", s)
+	}
+}
+
+// TextOptions changes how the text sink renders payloads
+type TextOptions struct {
+	// Pretty indents text messages holding valid JSON over several lines
+	Pretty bool
+	Binary BinaryFormat
+	// MaxBytes, if not zero, truncates the payloads longer than it once they
+	// are decoded, text is cut on a character boundary
+	MaxBytes int
+	// Color uses ANSI colors for the direction and control frames, meant for
+	// terminals
+	Color bool
+}
+
+// ANSI colors of the text sink
+const (
+	colorClient  = "36"   // cyan
+	colorServer  = "32"   // green
+	colorControl = "1;33" // bold yellow
+)
+
+// NewTextSink returns a text sink, as NewSink does, rendering payloads as
+// set by opts
+func NewTextSink(w io.Writer, opts TextOptions) Sink {
+	return &textSink{w: w, opts: opts}
+}
+
+type textSink struct {
+	lock sync.Mutex
+	w    io.Writer
+	opts TextOptions
+}
+
+func (s *textSink) WriteFrame(ev FrameEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	color := colorServer
+	if ev.Direction == ClientToServer.String() {
+		color = colorClient
+	}
+	opcode := ev.Opcode
+	switch opcode {
+	case OpPing.String(), OpPong.String(), OpClose.String():
+		opcode = s.paint(colorControl, opcode)
+	}
+	prefix := fmt.Sprintf("%s %s %s", ev.Time.Format(TimeFormat),
+		s.paint(color, ev.Direction+" "+connName(ev.RemoteAddr, ev.ConnID)), opcode)
+	var err error
+	switch {
+	case ev.Header != nil:
+		h := ev.Header
+		mask := "none"
+		if h.Masked {
+			mask = h.MaskKey
+		}
+		fin := 0
+		if h.Fin {
+			fin = 1
+		}
+		_, err = fmt.Fprintf(s.w, "%s fin=%d rsv=%d mask=%s len=%d\n", prefix,
+			fin, h.Rsv, mask, h.Length)
+	case ev.Rsv != 0:
+		// encoded by an extension that wasn't negotiated or failed to decode
+		prefix += fmt.Sprintf(" opaque rsv %d", ev.Rsv)
+		if ev.Frame == nil {
+			_, err = fmt.Fprintf(s.w, "%s %d bytes\n", prefix, ev.Length)
+		} else {
+			_, err = fmt.Fprintf(s.w, "%s%s\n", prefix, s.binary(ev.Frame.Payload))
+		}
+	case ev.CloseCode == CloseNoStatus:
+		_, err = fmt.Fprintf(s.w, "%s no status\n", prefix)
+	case ev.CloseCode != 0:
+		_, err = fmt.Fprintf(s.w, "%s %d %q\n", prefix, ev.CloseCode, ev.CloseReason)
+	case ev.Frame == nil:
+		_, err = fmt.Fprintf(s.w, "%s %d bytes\n", prefix, ev.Length)
+	case s.opts.Pretty && ev.Frame.Opcode == OpText && json.Valid(ev.Frame.Payload):
+		var buf bytes.Buffer
+		json.Indent(&buf, ev.Frame.Payload, "", "  ")
+		p, omitted := s.truncate(buf.Bytes(), true)
+		_, err = fmt.Fprintf(s.w, "%s\n%s%s\n", prefix, p, omittedSuffix(omitted))
+	case ev.Frame.Opcode == OpText, ev.Frame.Opcode == OpPing,
+		ev.Frame.Opcode == OpPong:
+		p, omitted := s.truncate(ev.Frame.Payload, true)
+		_, err = fmt.Fprintf(s.w, "%s %q%s\n", prefix, p, omittedSuffix(omitted))
+	default:
+		_, err = fmt.Fprintf(s.w, "%s%s\n", prefix, s.binary(ev.Frame.Payload))
+	}
+	return err
+}
+
+// connName is how the text sink shows a connection, its address followed by
+// its id if it has one
+func connName(addr, id string) string {
+	if id == "" {
+		return addr
+	}
+	return addr + " #" + id
+}
+
+// paint colors text if colors are enabled
+func (s *textSink) paint(color, text string) string {
+	if !s.opts.Color {
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
+
+// binary renders a binary payload as set by the options, along with the
+// separator from the frame header
+func (s *textSink) binary(p []byte) string {
+	p, omitted := s.truncate(p, false)
+	// hexdumps start on their own line so the offsets are aligned
+	sep := " "
+	var out string
+	switch s.opts.Binary {
+	case BinaryBase64:
+		out = base64.StdEncoding.EncodeToString(p)
+	case BinaryHexdump:
+		if len(p) > 0 {
+			sep = "\n"
+		}
+		out = strings.TrimSuffix(hex.Dump(p), "\n")
+	default:
+		out = hex.EncodeToString(p)
+	}
+	if omitted > 0 && sep == "\n" {
+		out += sep
+	}
+	return sep + out + omittedSuffix(omitted)
+}
+
+// truncate cuts p to the MaxBytes option and returns how many bytes were
+// left out. Text isn't cut in the middle of a UTF-8 sequence, the whole
+// character is left out instead
+func (s *textSink) truncate(p []byte, text bool) ([]byte, int) {
+	if s.opts.MaxBytes <= 0 || len(p) <= s.opts.MaxBytes {
+		return p, 0
+	}
+	n := s.opts.MaxBytes
+	if text {
+		// a sequence is at most 4 bytes, invalid bytes are cut anywhere
+		for i := 0; i < utf8.UTFMax-1 && n > 0 && !utf8.RuneStart(p[n]); i++ {
+			n--
+		}
+	}
+	return p[:n], len(p) - n
+}
+
+// omittedSuffix marks a truncated payload
+func omittedSuffix(omitted int) string {
+	if omitted == 0 {
+		return ""
+	}
+	return fmt.Sprintf("…(+%d bytes)", omitted)
+}
+
+func (s *textSink) WriteConn(ev ConnEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prefix := fmt.Sprintf("%s - %s", ev.Time.Format(TimeFormat),
+		connName(ev.RemoteAddr, ev.ConnID))
+	var err error
+	if ev.Event == ConnOpen {
+		_, err = fmt.Fprintf(s.w, "%s OPEN %s upstream %s protocol %q extensions %q\n",
+			prefix, ev.URL, ev.Upstream,
+			ev.ResponseHeader.Get("Sec-WebSocket-Protocol"),
+			strings.Join(ev.ResponseHeader.Values("Sec-WebSocket-Extensions"), ", "))
+		if err == nil && len(ev.Cookies) > 0 {
+			_, err = fmt.Fprintf(s.w, "%s COOKIES %q\n", prefix, strings.Join(ev.Cookies, "; "))
+		}
+		if err == nil && len(ev.SetCookies) > 0 {
+			_, err = fmt.Fprintf(s.w, "%s SET-COOKIES %q\n", prefix, strings.Join(ev.SetCookies, "; "))
+		}
+	} else {
+		status := "no close frame"
+		if ev.CloseCode != 0 {
+			status = fmt.Sprintf("close %d", ev.CloseCode)
+		}
+		if ev.Error != "" {
+			status += fmt.Sprintf(" error %q", ev.Error)
+		}
+		_, err = fmt.Fprintf(s.w, "%s CLOSED %s %d bytes %d frames %s %d bytes %d frames %s\n",
+			prefix, ClientToServer, ev.ClientBytes, ev.ClientFrames,
+			ServerToClient, ev.ServerBytes, ev.ServerFrames, status)
+	}
+	return err
+}
+
+type jsonSink struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func (s *jsonSink) WriteFrame(ev FrameEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.enc.Encode(ev)
+}
+
+func (s *jsonSink) WriteConn(ev ConnEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.enc.Encode(ev)
+}
+
+// FileSink writes events to a file through a FlushWriter
+type FileSink struct {
+	Sink
+	w *FlushWriter
+}
+
+// NewFileSink creates the named file and writes events to it in the given
+// format, as NewSink does. Writes are buffered and flushed every
+// flushInterval, if it isn't zero, and on Close
+func NewFileSink(name, format string, flushInterval time.Duration) (*FileSink, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := NewFlushWriter(f, flushInterval)
+	s, err := NewSink(format, w)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileSink{Sink: s, w: w}, nil
+}
+
+// WriteConn writes ev if the format records connections
+func (s *FileSink) WriteConn(ev ConnEvent) error {
+	if cs, ok := s.Sink.(ConnSink); ok {
+		return cs.WriteConn(ev)
+	}
+	return nil
+}
+
+// Close flushes the pending events and closes the file
+func (s *FileSink) Close() error {
+	return s.w.Close()
+}
+
+// SinkCallback returns an OnHijacked that decodes the messages of both
+// directions, inflating them if needed, and writes them to sink. A direction
+// stops being decoded after an error, either reading or from the sink
+func SinkCallback(sink Sink) OnHijacked {
+	return func(ctx context.Context, r *http.Request, in, out io.Reader) {
+		go sinkLoop(r, in, ClientToServer, sink)
+		go sinkLoop(r, out, ServerToClient, sink)
+	}
+}
+
+func sinkLoop(r *http.Request, rd io.Reader, dir Direction, sink Sink) {
+	// keep draining so the proxied connection doesn't get stuck
+	defer io.Copy(ioutil.Discard, rd)
+	mr := NewMessageReader(NewFrameReader(rd, dir == ClientToServer))
+	var inflate *Inflater
+	for {
+		f, err := mr.ReadMessage()
+		if err != nil {
+			return
+		}
+		if f.Compressed() {
+			if inflate == nil {
+				inflate = NewInflater(ResponseHeader(r), dir)
+			}
+			// frames that fail to inflate are written compressed
+			if inflate != nil {
+				inflate.Inflate(f)
+			}
+		}
+		if err := sink.WriteFrame(NewFrameEvent(r, dir, f, time.Now())); err != nil {
+			return
+		}
+	}
+}
+
+// NewChannelSniffer is like Sniffer but the decoded frames of every
+// connection are delivered on the returned channel, which holds up to buffer
+// events. The proxy never waits for the consumer, events that don't fit in
+// the channel are dropped, so it must be drained continuously. The channel is
+// never closed
+func NewChannelSniffer(h http.Handler, buffer int) (http.Handler, <-chan FrameEvent) {
+	ch := make(chan FrameEvent, buffer)
+	sink := SinkFunc(func(ev FrameEvent) error {
+		select {
+		case ch <- ev:
+		default:
+		}
+		return nil
+	})
+	return Sniffer(h, SinkCallback(sink)), ch
+}
@@ -0,0 +1,764 @@
+// Package sniffer logs the WebSocket traffic going through an http.Handler,
+// such as httputil.ReverseProxy, by wrapping the connections it hijacks
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OnHijacked callback that will be called every time a request has been
+// hijacked. The context is cancelled when the connection is done, the in and
+// out readers return an error from then on. Each reader is meant to be read
+// by its own goroutine, so anything shared between them must be
+// synchronized
+type OnHijacked func(ctx context.Context, r *http.Request, in, out io.Reader)
+
+// Direction of the traffic through the proxy
+type Direction int
+
+// Traffic directions
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+// String returns the arrow used to show the direction in the logs
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "<"
+	case ServerToClient:
+		return ">"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// OnFrame callback that will be called for every frame before it reaches the
+// peer. The returned frame replaces the original one, returning nil drops it.
+// Both directions call it concurrently, each from its own goroutine
+type OnFrame func(dir Direction, frame *Frame) *Frame
+
+// TeeConn will forward any reads or writes to a pair of io.Writer. The
+// writers are also closed when the connection is closed if they implement
+// io.Closer. Errors of the writers never reach the connection, a writer that
+// fails stops receiving traffic
+func TeeConn(conn net.Conn, in, out io.Writer) net.Conn {
+	return &teeConn{
+		Conn:   conn,
+		in:     in,
+		out:    out,
+		reader: io.TeeReader(conn, newObserver(ClientToServer, in)),
+		writer: &teeWriter{w: conn, obs: newObserver(ServerToClient, out)},
+	}
+}
+
+// TeeConnN is like TeeConn but only the first n bytes of each direction are
+// written to in and out, the rest of the traffic still goes through
+func TeeConnN(conn net.Conn, in, out io.Writer, n int64) net.Conn {
+	return &teeConn{
+		Conn:   conn,
+		in:     in,
+		out:    out,
+		reader: io.TeeReader(conn, newObserver(ClientToServer, &capWriter{w: in, n: n})),
+		writer: &teeWriter{w: conn, obs: newObserver(ServerToClient, &capWriter{w: out, n: n})},
+	}
+}
+
+// observer copies the traffic to w until w fails. The error is logged once
+// and never returned, the traffic is no longer observed but the proxied
+// connection isn't affected
+type observer struct {
+	dir    Direction
+	w      io.Writer
+	failed bool
+}
+
+func newObserver(dir Direction, w io.Writer) *observer {
+	return &observer{dir: dir, w: w}
+}
+
+// Write always succeeds
+func (o *observer) Write(p []byte) (int, error) {
+	if o.failed {
+		return len(p), nil
+	}
+	if _, err := o.w.Write(p); err != nil {
+		o.failed = true
+		log.Printf("sniffer: %s observer failed, the rest of the traffic won't "+
+			"be sniffed: %v", o.dir, err)
+	}
+	return len(p), nil
+}
+
+// teeWriter writes to w and then copies what was written to obs, only
+// errors of w are returned
+type teeWriter struct {
+	w   io.Writer
+	obs *observer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.obs.Write(p[:n])
+	return n, err
+}
+
+// capWriter writes the first n bytes to w and silently discards the rest, so
+// the connection it copies keeps working past the cap
+type capWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if c.n <= 0 {
+		return len(p), nil
+	}
+	b := p
+	if int64(len(b)) > c.n {
+		b = b[:c.n]
+	}
+	n, err := c.w.Write(b)
+	c.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// TeeFrameConn is like TeeConn but the traffic is parsed into frames and
+// passed through onFrame, the io.Writer pair receives the resulting frames as
+// they are sent to the peer
+func TeeFrameConn(conn net.Conn, in, out io.Writer, onFrame OnFrame) net.Conn {
+	obs := newObserver(ClientToServer, in)
+	return &teeConn{
+		Conn:     conn,
+		in:       in,
+		out:      out,
+		reader:   io.TeeReader(conn, obs),
+		inObs:    obs,
+		writer:   &teeWriter{w: conn, obs: newObserver(ServerToClient, out)},
+		onFrame:  onFrame,
+		frames:   NewFrameReader(conn, true),
+		reads:    make(chan frameRead),
+		injected: make(chan *Frame),
+		done:     make(chan struct{}),
+	}
+}
+
+// teeConn is used by two goroutines of the hijacking handler, one calling
+// Read to copy the client traffic and one calling Write to copy the server
+// one. The state of each direction is only touched by its goroutine, except
+// what injected frames need: the injected channel on the read side and
+// wlock on the write side. Close may be called from any goroutine
+type teeConn struct {
+	net.Conn
+	in     io.Writer
+	out    io.Writer
+	reader io.Reader
+	writer io.Writer
+
+	onFrame OnFrame
+	// inObs copies the re-encoded client frames to in
+	inObs *observer
+	// frames reads client frames from the conn, the re-encoded frames wait
+	// in rbuf until they are read
+	frames *FrameReader
+	rbuf   bytes.Buffer
+	// client frames are read in the background so injected frames don't
+	// wait for the client, readErr is the error that stopped it
+	readOnce sync.Once
+	reads    chan frameRead
+	readErr  error
+	injected chan *Frame
+	// sentClose is set once a close frame has been sent to the server
+	sentClose bool
+	// wlock keeps injected frames from splitting the written ones, wbuf holds
+	// written bytes until they form a whole frame
+	wlock sync.Mutex
+	wbuf  []byte
+
+	// idle, if not zero, closes the connection when there is no traffic in
+	// either direction for that long
+	idle time.Duration
+	// headerTimeout, if not zero, closes the connection when a client frame
+	// header takes longer than that to arrive
+	headerTimeout time.Duration
+
+	closeOnce sync.Once
+	// done is closed along with the connection
+	done chan struct{}
+}
+
+type frameRead struct {
+	frame *Frame
+	err   error
+}
+
+// ErrIdleTimeout is returned by the readers passed to OnHijacked once the
+// connection has been closed for being idle
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// touch pushes the idle deadlines back, reads and writes keep the whole
+// connection alive
+func (c *teeConn) touch(write bool) {
+	if c.idle == 0 {
+		return
+	}
+	deadline := time.Now().Add(c.idle)
+	c.Conn.SetReadDeadline(deadline)
+	if write {
+		c.Conn.SetWriteDeadline(deadline)
+	}
+}
+
+// timeout closes the connection if err is an idle deadline being exceeded,
+// so the reverse proxy tears down both directions
+func (c *teeConn) timeout(err error) error {
+	if c.idle == 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	c.close(ErrIdleTimeout)
+	return ErrIdleTimeout
+}
+
+// ErrClientGone is returned by the reads of the reverse proxy once the client
+// has disconnected. Unlike an EOF, which the proxy answers by half-closing
+// the upstream and waiting for it, an error makes it close it right away
+var ErrClientGone = errors.New("websocket: client disconnected")
+
+// hangup converts an EOF from the client into ErrClientGone
+func hangup(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrClientGone
+	}
+	return err
+}
+
+func (c *teeConn) Read(p []byte) (n int, err error) {
+	defer func() { metrics.addBytes(ClientToServer, n) }()
+	c.touch(false)
+	if c.onFrame == nil {
+		n, err = c.reader.Read(p)
+		return n, hangup(c.timeout(err))
+	}
+	c.readOnce.Do(func() { go c.readFrames() })
+	for c.rbuf.Len() == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		var f *Frame
+		select {
+		case r := <-c.reads:
+			if r.err != nil {
+				c.readErr = hangup(c.timeout(r.err))
+				if c.readErr != ErrClientGone || c.sentClose {
+					continue
+				}
+				// tell the server the client is gone, as the client
+				// would have done had it closed cleanly
+				f = &Frame{Fin: true, Opcode: OpClose, Payload: []byte{
+					CloseGoingAway >> 8, CloseGoingAway & 0xff}}
+				if err := f.Mask(); err != nil {
+					return 0, err
+				}
+				break
+			}
+			if f = c.onFrame(ClientToServer, r.frame); f == nil {
+				continue
+			}
+		case f = <-c.injected:
+		case <-c.done:
+			c.readErr = net.ErrClosed
+			continue
+		}
+		// client frames must be masked again before reaching the server
+		f.Masked = true
+		if f.Opcode == OpClose {
+			c.sentClose = true
+		}
+		if err := WriteFrame(&c.rbuf, f); err != nil {
+			return 0, err
+		}
+	}
+	n, _ = c.rbuf.Read(p)
+	c.inObs.Write(p[:n])
+	return n, nil
+}
+
+// ErrHeaderTimeout is returned by the readers passed to OnHijacked once the
+// connection has been closed for a client sending a frame header too slowly
+var ErrHeaderTimeout = errors.New("frame header timeout")
+
+// readFrame reads the next client frame. With a header timeout, the header
+// must arrive within it once its first byte has, a client dripping it byte
+// by byte would otherwise hold the connection forever
+func (c *teeConn) readFrame() (*Frame, error) {
+	if c.headerTimeout == 0 {
+		return c.frames.ReadFrame()
+	}
+	// waiting for a frame to start is up to the idle timeout
+	if _, err := c.frames.r.Peek(1); err != nil {
+		return nil, err
+	}
+	t := time.AfterFunc(c.headerTimeout, func() { c.close(ErrHeaderTimeout) })
+	f, length, err := c.frames.readHeader()
+	if !t.Stop() {
+		return nil, ErrHeaderTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.frames.readPayload(f, length)
+}
+
+// readFrames reads client frames until the conn fails or is closed
+func (c *teeConn) readFrames() {
+	for {
+		f, err := c.readFrame()
+		select {
+		case c.reads <- frameRead{f, err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *teeConn) Write(p []byte) (n int, err error) {
+	defer func() { metrics.addBytes(ServerToClient, n) }()
+	c.touch(true)
+	if c.onFrame == nil {
+		n, err = c.writer.Write(p)
+		return n, c.timeout(err)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		size, ok := frameSize(c.wbuf)
+		if !ok || uint64(len(c.wbuf)) < size {
+			return len(p), nil
+		}
+		raw := c.wbuf[:size]
+		c.wbuf = c.wbuf[size:]
+		f, err := NewFrameReader(bytes.NewReader(raw), false).ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		if f = c.onFrame(ServerToClient, f); f == nil {
+			continue
+		}
+		if err := WriteFrame(c.writer, f); err != nil {
+			return 0, c.timeout(err)
+		}
+	}
+}
+
+func (c *teeConn) Close() error {
+	return c.close(nil)
+}
+
+// close closes the connection, the readers on the other side get err once
+// they have read all the data, or io.EOF if it is nil
+func (c *teeConn) close(err error) error {
+	c.closeOnce.Do(func() {
+		metrics.connClosed()
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	cerr := c.Conn.Close()
+	for _, w := range []io.Writer{c.in, c.out} {
+		switch closer := w.(type) {
+		case interface{ CloseWithError(error) error }:
+			if err == nil {
+				err = io.EOF
+			}
+			closer.CloseWithError(err)
+		case io.Closer:
+			closer.Close()
+		}
+	}
+	return cerr
+}
+
+// CallbackHijacker is a wrapper around an http.ResponseWriter that will invoke
+// our OnHijacked callback whenever a Hijack() is succesfully done
+func CallbackHijacker(w http.ResponseWriter, r *http.Request,
+	cb OnHijacked) http.ResponseWriter {
+	return FrameHijacker(w, r, cb, nil)
+}
+
+// FrameHijacker is like CallbackHijacker but the frames of the hijacked
+// connection are passed through onFrame, if it isn't nil. Writers that can't
+// be hijacked are returned as they are, with a warning in the standard
+// logger since the connection won't be sniffed
+func FrameHijacker(w http.ResponseWriter, r *http.Request, cb OnHijacked,
+	onFrame OnFrame) http.ResponseWriter {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("sniffer: %T doesn't implement http.Hijacker, %s %s won't "+
+			"be sniffed\n", w, r.RemoteAddr, r.URL)
+		return w
+	}
+	// requests that weren't prepared by the sniffer get their own
+	hs := GetHandshake(r)
+	if hs == nil {
+		hs = &Handshake{}
+	}
+	return &callbackHijacker{
+		ResponseWriter: w,
+		hijacker:       h,
+		request:        r,
+		callback:       cb,
+		onFrame:        onFrame,
+		handshake:      hs,
+	}
+}
+
+type callbackHijacker struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	request  *http.Request
+	callback OnHijacked
+	onFrame  OnFrame
+	// handshake is passed to the callback in the request context
+	handshake *Handshake
+}
+
+// WriteHeader records the response headers of handlers that write the 101
+// themselves before hijacking
+func (h *callbackHijacker) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols {
+		h.handshake.Header = h.ResponseWriter.Header().Clone()
+	}
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *callbackHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hs := h.handshake
+	if hs.Header == nil {
+		// the reverse proxy copies the upstream response headers after the
+		// hijack, but into this same map
+		hs.Header = h.ResponseWriter.Header()
+	}
+	conn, buf, err := h.hijacker.Hijack()
+	if err != nil {
+		return conn, buf, err
+	}
+	// connect code expecting an `io.Reader` with code expecting an
+	// `io.Writer`, without letting a slow reader block the connection
+	in := newBufferedPipe(ClientToServer, pipeLimit)
+	out := newBufferedPipe(ServerToClient, pipeLimit)
+
+	var tee net.Conn
+	if counts, ok := h.request.Context().Value(countKey{}).(*[2]FrameCounts); ok {
+		// the pipes are still closed once the request is done
+		tee = TeeConn(conn, NewFrameCounter(&counts[ClientToServer]),
+			NewFrameCounter(&counts[ServerToClient]))
+	} else if h.onFrame != nil {
+		tee = TeeFrameConn(conn, in, out, h.onFrame)
+	} else {
+		tee = TeeConn(conn, in, out)
+	}
+	tee.(*teeConn).idle, _ = h.request.Context().Value(idleKey{}).(time.Duration)
+	tee.(*teeConn).headerTimeout, _ = h.request.Context().Value(headerTimeoutKey{}).(time.Duration)
+
+	// invoke callback
+	ctx := context.WithValue(h.request.Context(), handshakeKey{}, hs)
+	ctx = context.WithValue(ctx, connKey{}, tee)
+	id := strconv.FormatUint(atomic.AddUint64(&connCount, 1), 10)
+	ctx = context.WithValue(ctx, connIDKey{}, id)
+	h.callback(ctx, h.request.WithContext(ctx), in, out)
+
+	// unblock the readers once the request is done
+	go func() {
+		<-ctx.Done()
+		in.CloseWithError(ctx.Err())
+		out.CloseWithError(ctx.Err())
+	}()
+
+	metrics.connOpened()
+
+	// return wrapped conn
+	return tee, buf, nil
+}
+
+type idleKey struct{}
+
+type headerTimeoutKey struct{}
+
+type strictKey struct{}
+
+type http2Key struct{}
+
+// ErrNotHijackable is the error answered by Strict handlers
+var ErrNotHijackable = errors.New("websocket: connection can't be sniffed, " +
+	"the response writer doesn't implement http.Hijacker")
+
+// Strict is a wrapper around http.Handler that makes the sniffer under h
+// answer websocket upgrades it can't hijack with a 500, instead of proxying
+// them without sniffing
+func Strict(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), strictKey{}, true)))
+	})
+}
+
+// HTTP2 is a wrapper around http.Handler that makes the sniffer under h
+// accept websockets over HTTP/2, the extended CONNECT of RFC 8441, and sniff
+// them like HTTP/1.1 upgrades. Without it they reach the handler untouched
+func HTTP2(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), http2Key{}, true)))
+	})
+}
+
+type connKey struct{}
+
+// SetOnFrame replaces the onFrame of the connection of a request passed to
+// OnHijacked, so each connection can modify its frames on its own. It must be
+// called from the callback, before the connection is used, and like Inject it
+// only works with connections hijacked by FrameHijacker with an onFrame. A nil
+// onFrame keeps the current one
+func SetOnFrame(r *http.Request, onFrame OnFrame) error {
+	c, _ := r.Context().Value(connKey{}).(*teeConn)
+	if c == nil || c.onFrame == nil {
+		return ErrNotInjectable
+	}
+	if onFrame != nil {
+		c.onFrame = onFrame
+	}
+	return nil
+}
+
+// ErrNotInjectable is returned by Inject and SetOnFrame for connections whose
+// frames aren't parsed, frames can only be injected between whole frames
+var ErrNotInjectable = errors.New("websocket: connection frames aren't parsed")
+
+// Inject sends f to the peer the direction points to on the connection of a
+// request passed to OnHijacked, as if it was sent by the other one. The
+// frame is seen by the readers passed to OnHijacked. It only works with
+// connections hijacked by FrameHijacker with an onFrame, and client frames
+// are masked with a random key
+func Inject(r *http.Request, dir Direction, f *Frame) error {
+	c, _ := r.Context().Value(connKey{}).(*teeConn)
+	if c == nil || c.onFrame == nil {
+		return ErrNotInjectable
+	}
+	f.Masked = false
+	if dir == ClientToServer {
+		if err := f.Mask(); err != nil {
+			return err
+		}
+		select {
+		case c.injected <- f:
+			return nil
+		case <-c.done:
+			return net.ErrClosed
+		}
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+	return WriteFrame(c.writer, f)
+}
+
+// IdleTimeout is a wrapper around http.Handler that makes the connections
+// hijacked by the sniffer under h close when there is no traffic in either
+// direction for d. HTTP/2 streams ignore it
+func IdleTimeout(h http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), idleKey{}, d)))
+	})
+}
+
+// HeaderTimeout is a wrapper around http.Handler that makes the connections
+// hijacked by the sniffer under h close when a client takes longer than d to
+// send a frame header once it has started it. Only connections whose frames
+// are parsed, hijacked by FrameHijacker with an onFrame, are guarded
+func HeaderTimeout(h http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), headerTimeoutKey{}, d)))
+	})
+}
+
+type handshakeKey struct{}
+
+// Handshake is the negotiated upgrade of a sniffed connection
+type Handshake struct {
+	// Upstream is the url the request was proxied to, if known
+	Upstream *url.URL
+	// Header holds the handshake response headers
+	Header http.Header
+}
+
+// Protocol returns the negotiated subprotocol
+func (hs *Handshake) Protocol() string {
+	return hs.Header.Get("Sec-WebSocket-Protocol")
+}
+
+// Extensions returns the negotiated extensions, with their parameters
+func (hs *Handshake) Extensions() []string {
+	var exts []string
+	for _, v := range hs.Header.Values("Sec-WebSocket-Extensions") {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				exts = append(exts, e)
+			}
+		}
+	}
+	return exts
+}
+
+// connCount numbers the hijacked connections
+var connCount uint64
+
+type connIDKey struct{}
+
+// ConnID returns the id of the connection of a request passed to OnHijacked,
+// or an empty string for other requests. Connections are numbered in the
+// order they are hijacked, starting from 1
+func ConnID(r *http.Request) string {
+	id, _ := r.Context().Value(connIDKey{}).(string)
+	return id
+}
+
+// GetHandshake returns the handshake of a request being sniffed. Requests
+// passed to OnHijacked always have one, although with handlers other than
+// httputil.ReverseProxy using RecordHandshake the headers may not be
+// populated until the first frame has been exchanged
+func GetHandshake(r *http.Request) *Handshake {
+	hs, _ := r.Context().Value(handshakeKey{}).(*Handshake)
+	return hs
+}
+
+// RecordHandshake stores the upstream response in the handshake of its
+// request, so it is known by the time OnHijacked is called. It is meant to be
+// used as httputil.ReverseProxy.ModifyResponse
+func RecordHandshake(res *http.Response) error {
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Request == nil {
+		return nil
+	}
+	if hs := GetHandshake(res.Request); hs != nil {
+		hs.Upstream = res.Request.URL
+		hs.Header = res.Header.Clone()
+	}
+	return nil
+}
+
+// ResponseHeader returns the handshake response headers of a hijacked request
+// as passed to OnHijacked
+func ResponseHeader(r *http.Request) http.Header {
+	if hs := GetHandshake(r); hs != nil {
+		return hs.Header
+	}
+	return nil
+}
+
+// Sniffer is a wrapper around http.Handler that will invoke CallbackHijacker
+// every time ServeHTTP() is called.
+func Sniffer(h http.Handler, callback OnHijacked) http.Handler {
+	return FrameSniffer(h, callback, nil)
+}
+
+// FrameSniffer is like Sniffer but it will invoke FrameHijacker so frames can
+// be modified by onFrame
+func FrameSniffer(h http.Handler, callback OnHijacked,
+	onFrame OnFrame) http.Handler {
+	return &sniffer{
+		handler:  h,
+		callback: callback,
+		onFrame:  onFrame,
+	}
+}
+
+type sniffer struct {
+	handler  http.Handler
+	callback OnHijacked
+	onFrame  OnFrame
+}
+
+func (s *sniffer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if IsExtendedConnect(r) && r.Context().Value(http2Key{}) != nil {
+		hw, hr, err := http2Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w, r = hw, hr
+	}
+	// plain http requests have nothing to sniff
+	if IsWebSocketUpgrade(r) {
+		if _, ok := w.(http.Hijacker); !ok && r.Context().Value(strictKey{}) != nil {
+			http.Error(w, ErrNotHijackable.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), handshakeKey{}, &Handshake{})
+		r = r.WithContext(ctx)
+		w = FrameHijacker(w, r, s.callback, s.onFrame)
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// IsWebSocketUpgrade reports whether the request is a websocket handshake
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// acceptGUID is appended to the key of a handshake to compute the accept
+// value, as defined in RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// AcceptKey returns the Sec-WebSocket-Accept value a server must answer to
+// the given Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ValidAccept reports whether accept is the Sec-WebSocket-Accept value that
+// answers the Sec-WebSocket-Key key, clients must fail the connection when it
+// isn't
+func ValidAccept(key, accept string) bool {
+	return key != "" && accept == AcceptKey(key)
+}
+
+// headerHasToken reports whether the comma separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
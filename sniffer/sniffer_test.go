@@ -0,0 +1,120 @@
+package sniffer_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/igolaizola/websocket-proxy-sniffer/sniffer"
+)
+
+// failingWriter is a broken capture, every write fails
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// quietLog drops the warnings of the failing observers for the length of a
+// test
+func quietLog(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestTeeConnObserverFails(t *testing.T) {
+	quietLog(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := sniffer.TeeConn(server, failingWriter{}, failingWriter{})
+	defer conn.Close()
+
+	// twice, the observer must keep failing quietly once it has failed
+	for i := 0; i < 2; i++ {
+		wrote := make(chan struct{})
+		go func() {
+			defer close(wrote)
+			client.Write([]byte("hello"))
+		}()
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("client to server read failed: %v", err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("client to server got %q, want %q", b, "hello")
+		}
+		<-wrote
+
+		wrote = make(chan struct{})
+		go func() {
+			defer close(wrote)
+			if _, err := conn.Write([]byte("world")); err != nil {
+				t.Errorf("server to client write failed: %v", err)
+			}
+		}()
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("server to client read failed: %v", err)
+		}
+		if string(b) != "world" {
+			t.Fatalf("server to client got %q, want %q", b, "world")
+		}
+		<-wrote
+	}
+}
+
+func TestTeeFrameConnObserverFails(t *testing.T) {
+	quietLog(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	onFrame := func(dir sniffer.Direction, f *sniffer.Frame) *sniffer.Frame {
+		return f
+	}
+	conn := sniffer.TeeFrameConn(server, failingWriter{}, failingWriter{}, onFrame)
+	defer conn.Close()
+
+	serverFrames := sniffer.NewFrameReader(conn, true)
+	clientFrames := sniffer.NewFrameReader(client, false)
+	for i := 0; i < 2; i++ {
+		wrote := make(chan struct{})
+		go func() {
+			defer close(wrote)
+			f := &sniffer.Frame{Fin: true, Opcode: sniffer.OpText, Payload: []byte("hello")}
+			if err := f.Mask(); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := sniffer.WriteFrame(client, f); err != nil {
+				t.Errorf("client write failed: %v", err)
+			}
+		}()
+		f, err := serverFrames.ReadFrame()
+		if err != nil {
+			t.Fatalf("client to server read failed: %v", err)
+		}
+		if !bytes.Equal(f.Payload, []byte("hello")) {
+			t.Fatalf("client to server got %q, want %q", f.Payload, "hello")
+		}
+		<-wrote
+
+		wrote = make(chan struct{})
+		go func() {
+			defer close(wrote)
+			f := &sniffer.Frame{Fin: true, Opcode: sniffer.OpText, Payload: []byte("world")}
+			if err := sniffer.WriteFrame(conn, f); err != nil {
+				t.Errorf("server to client write failed: %v", err)
+			}
+		}()
+		if f, err = clientFrames.ReadFrame(); err != nil {
+			t.Fatalf("server to client read failed: %v", err)
+		}
+		if !bytes.Equal(f.Payload, []byte("world")) {
+			t.Fatalf("server to client got %q, want %q", f.Payload, "world")
+		}
+		<-wrote
+	}
+}